@@ -0,0 +1,196 @@
+// Package ast declares the types used to represent syntax trees of bmatch
+// expressions, and functions to traverse them.
+package ast
+
+// A Node is a node in the syntax tree of a bmatch expression.
+// Positions are byte offsets into the expression.
+type Node interface {
+	Pos() int // position of the first character of the node
+	End() int // position after the last character of the node
+	// String renders the node as a bmatch expression.
+	String() string
+	node()
+}
+
+// A StringLit is a string literal like 'foo', '~foo', 'word:foo' or '^foo$'.
+// It matches if the input contains Value.
+type StringLit struct {
+	From        int    // position of the first character
+	To          int    // position after the last character
+	Value       string // the unescaped string
+	IgnoreCase  bool   // match case-insensitively ('~' prefix)
+	WholeWord   bool   // match whole words only ('word:' prefix)
+	AnchorStart bool   // match at the start of the input only ('^' prefix)
+	AnchorEnd   bool   // match at the end of the input only ('$' suffix)
+}
+
+// A RegexLit is a regex literal like '/fo+/' or '/fo+/i'.
+// It matches if the input matches Pattern.
+type RegexLit struct {
+	From    int    // position of the opening slash
+	To      int    // position after the closing slash or the flags
+	Pattern string // the unescaped regular expression
+	Flags   string // flags after the closing slash, any of "imsU"
+}
+
+// A GlobLit is a glob literal like 'glob:user-*-prod'.
+// It matches if the input contains a string that matches Pattern.
+// In Pattern, '*' matches any string, '?' matches any character,
+// and a backslash escapes the following character.
+type GlobLit struct {
+	From        int    // position of the first character
+	To          int    // position after the last character
+	Pattern     string // the glob pattern
+	IgnoreCase  bool   // match case-insensitively ('~' prefix)
+	AnchorStart bool   // match at the start of the input only ('^' prefix)
+	AnchorEnd   bool   // match at the end of the input only ('$' suffix)
+}
+
+// A CountExpr is a literal with an occurrence count like 'foo{2}',
+// 'foo{2,}' or '/fo+/{2,5}'. It matches if X matches at least Min and
+// at most Max times, not overlapping.
+type CountExpr struct {
+	From int  // position of X
+	To   int  // position after the closing brace
+	X    Node // a StringLit, RegexLit or GlobLit
+	Min  int
+	Max  int // -1 if there is no maximum
+}
+
+// A RefExpr is a reference to a named definition like '$noise'.
+// X is the parsed definition, its positions are byte offsets into the
+// definition, not into the expression.
+type RefExpr struct {
+	From int // position of the '$'
+	To   int // position after the name
+	Name string
+	X    Node
+}
+
+// A CallExpr is a function call like '@iban' or '@vip(gold, silver)'.
+// It matches if the matcher that the function returns for Args matches.
+type CallExpr struct {
+	From int // position of the '@'
+	To   int // position after the name or the closing parenthesis
+	Name string
+	Args []string // the unquoted arguments
+}
+
+// A NotExpr is a NOT expression like 'NOT foo'.
+// It matches if X does not match.
+type NotExpr struct {
+	From int // position of the NOT keyword
+	To   int // position after X
+	X    Node
+}
+
+// An AndExpr is an AND expression like 'foo AND bar'.
+// It matches if all operands match.
+type AndExpr struct {
+	From     int // position of the first operand
+	To       int // position after the last operand
+	Operands []Node
+}
+
+// An OrExpr is an OR expression like 'foo OR bar'.
+// It matches if at least one operand matches.
+type OrExpr struct {
+	From     int // position of the first operand
+	To       int // position after the last operand
+	Operands []Node
+}
+
+// A XorExpr is an exclusive-or expression like 'foo XOR bar'.
+// It matches if an odd number of operands match.
+type XorExpr struct {
+	From     int // position of the first operand
+	To       int // position after the last operand
+	Operands []Node
+}
+
+// An ImpliesExpr is an implication like 'foo IMPLIES bar'.
+// It matches if X does not match or Y matches.
+type ImpliesExpr struct {
+	From int // position of X
+	To   int // position after Y
+	X    Node
+	Y    Node
+}
+
+// A NearExpr is a proximity expression like 'foo NEAR/5 bar' or
+// 'foo BEFORE/5 bar'. It matches if X and Y match at most Distance
+// whitespace-separated words apart. If Ordered is set (BEFORE), the match
+// of X must end before the match of Y starts.
+type NearExpr struct {
+	From     int // position of X
+	To       int // position after Y
+	X        Node
+	Y        Node
+	Distance int
+	Ordered  bool
+}
+
+// A ThenExpr is a sequence expression like 'foo THEN bar'.
+// It matches if the operands match in this order, each match ending
+// before the match of the next operand starts.
+type ThenExpr struct {
+	From     int // position of the first operand
+	To       int // position after the last operand
+	Operands []Node
+}
+
+// A ThresholdExpr is a threshold expression like 'ATLEAST 2 (foo, bar, baz)'.
+// It matches if the number of matching operands is at least (ATLEAST),
+// exactly (EXACTLY) or at most (ATMOST) Count.
+type ThresholdExpr struct {
+	From     int    // position of the keyword
+	To       int    // position after the closing parenthesis
+	Op       string // "ATLEAST", "EXACTLY" or "ATMOST"
+	Count    int
+	Operands []Node
+}
+
+func (n *StringLit) Pos() int     { return n.From }
+func (n *RegexLit) Pos() int      { return n.From }
+func (n *GlobLit) Pos() int       { return n.From }
+func (n *CountExpr) Pos() int     { return n.From }
+func (n *RefExpr) Pos() int       { return n.From }
+func (n *CallExpr) Pos() int      { return n.From }
+func (n *NotExpr) Pos() int       { return n.From }
+func (n *AndExpr) Pos() int       { return n.From }
+func (n *OrExpr) Pos() int        { return n.From }
+func (n *XorExpr) Pos() int       { return n.From }
+func (n *ImpliesExpr) Pos() int   { return n.From }
+func (n *NearExpr) Pos() int      { return n.From }
+func (n *ThenExpr) Pos() int      { return n.From }
+func (n *ThresholdExpr) Pos() int { return n.From }
+
+func (n *StringLit) End() int     { return n.To }
+func (n *RegexLit) End() int      { return n.To }
+func (n *GlobLit) End() int       { return n.To }
+func (n *CountExpr) End() int     { return n.To }
+func (n *RefExpr) End() int       { return n.To }
+func (n *CallExpr) End() int      { return n.To }
+func (n *NotExpr) End() int       { return n.To }
+func (n *AndExpr) End() int       { return n.To }
+func (n *OrExpr) End() int        { return n.To }
+func (n *XorExpr) End() int       { return n.To }
+func (n *ImpliesExpr) End() int   { return n.To }
+func (n *NearExpr) End() int      { return n.To }
+func (n *ThenExpr) End() int      { return n.To }
+func (n *ThresholdExpr) End() int { return n.To }
+
+func (*StringLit) node()     {}
+func (*RegexLit) node()      {}
+func (*GlobLit) node()       {}
+func (*CountExpr) node()     {}
+func (*RefExpr) node()       {}
+func (*CallExpr) node()      {}
+func (*NotExpr) node()       {}
+func (*AndExpr) node()       {}
+func (*OrExpr) node()        {}
+func (*XorExpr) node()       {}
+func (*ImpliesExpr) node()   {}
+func (*NearExpr) node()      {}
+func (*ThenExpr) node()      {}
+func (*ThresholdExpr) node() {}
@@ -0,0 +1,30 @@
+package ast_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cvilsmeier/bmatch"
+	"github.com/cvilsmeier/bmatch/ast"
+)
+
+func ExampleInspect() {
+	expr := "foo OR NOT (bar AND /ba+z/)"
+	node, err := bmatch.ParseExpr(expr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.StringLit:
+			fmt.Printf("string %q at %d\n", n.Value, n.Pos())
+		case *ast.RegexLit:
+			fmt.Printf("regex %q at %d\n", n.Pattern, n.Pos())
+		}
+		return true
+	})
+	// Output:
+	// string "foo" at 0
+	// string "bar" at 12
+	// regex "ba+z" at 20
+}
@@ -0,0 +1,113 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cvilsmeier/bmatch/internal"
+)
+
+func (n *StringLit) String() string {
+	var flags string
+	if n.IgnoreCase {
+		flags += "i"
+	}
+	if n.WholeWord {
+		flags += "w"
+	}
+	if n.AnchorStart {
+		flags += "^"
+	}
+	if n.AnchorEnd {
+		flags += "$"
+	}
+	return internal.QuoteFlaggedString(n.Value, flags)
+}
+
+func (n *GlobLit) String() string {
+	flags := "g"
+	if n.IgnoreCase {
+		flags = "ig"
+	}
+	if n.AnchorStart {
+		flags += "^"
+	}
+	if n.AnchorEnd {
+		flags += "$"
+	}
+	return internal.QuoteFlaggedString(n.Pattern, flags)
+}
+
+func (n *RegexLit) String() string { return internal.QuoteRegex(n.Pattern) + n.Flags }
+
+func (n *CountExpr) String() string { return n.X.String() + internal.FormatCount(n.Min, n.Max) }
+
+func (n *RefExpr) String() string { return "$" + n.Name }
+
+func (n *CallExpr) String() string { return internal.FormatCall(n.Name, n.Args) }
+
+func (n *NotExpr) String() string { return "NOT " + operand(n.X, internal.NotPrec) }
+
+func (n *AndExpr) String() string { return join(n.Operands, " AND ", internal.AndPrec) }
+
+func (n *OrExpr) String() string { return join(n.Operands, " OR ", internal.OrPrec) }
+
+func (n *XorExpr) String() string { return join(n.Operands, " XOR ", internal.XorPrec) }
+
+func (n *ImpliesExpr) String() string {
+	// IMPLIES is right-associative
+	return operand(n.X, internal.ImpliesPrec+1) + " IMPLIES " + operand(n.Y, internal.ImpliesPrec)
+}
+
+func (n *NearExpr) String() string {
+	op := fmt.Sprintf(" NEAR/%d ", n.Distance)
+	if n.Ordered {
+		op = fmt.Sprintf(" BEFORE/%d ", n.Distance)
+	}
+	// NEAR and BEFORE are left-associative
+	return operand(n.X, internal.NearPrec) + op + operand(n.Y, internal.NearPrec+1)
+}
+
+func (n *ThenExpr) String() string {
+	// THEN has the same precedence as the left-associative NEAR
+	strs := make([]string, len(n.Operands))
+	for i, node := range n.Operands {
+		strs[i] = operand(node, internal.NearPrec+min(i, 1))
+	}
+	return strings.Join(strs, " THEN ")
+}
+
+func (n *ThresholdExpr) String() string {
+	// operands are separated by commas, so they never need parentheses
+	return fmt.Sprintf("%s %d (%s)", n.Op, n.Count, join(n.Operands, ", ", internal.ImpliesPrec))
+}
+
+func join(nodes []Node, sep string, opPrec int) string {
+	strs := make([]string, len(nodes))
+	for i, node := range nodes {
+		strs[i] = operand(node, opPrec)
+	}
+	return strings.Join(strs, sep)
+}
+
+// operand renders a node as operand of an operator with precedence opPrec.
+func operand(node Node, opPrec int) string {
+	var prec int
+	switch node.(type) {
+	case *NotExpr:
+		prec = internal.NotPrec
+	case *AndExpr:
+		prec = internal.AndPrec
+	case *OrExpr:
+		prec = internal.OrPrec
+	case *XorExpr:
+		prec = internal.XorPrec
+	case *ImpliesExpr:
+		prec = internal.ImpliesPrec
+	case *NearExpr, *ThenExpr:
+		prec = internal.NearPrec
+	default:
+		prec = internal.LiteralPrec
+	}
+	return internal.Paren(node.String(), prec, opPrec)
+}
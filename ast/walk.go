@@ -0,0 +1,75 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by [Walk].
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a syntax tree in depth-first order. It starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor w
+// for each of the non-nil children of node, followed by a call of
+// w.Visit(nil).
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *StringLit, *RegexLit, *GlobLit, *CallExpr:
+		// nothing to do
+	case *CountExpr:
+		Walk(v, n.X)
+	case *RefExpr:
+		if n.X != nil {
+			Walk(v, n.X)
+		}
+	case *NotExpr:
+		Walk(v, n.X)
+	case *AndExpr:
+		walkList(v, n.Operands)
+	case *OrExpr:
+		walkList(v, n.Operands)
+	case *XorExpr:
+		walkList(v, n.Operands)
+	case *ImpliesExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+	case *NearExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+	case *ThenExpr:
+		walkList(v, n.Operands)
+	case *ThresholdExpr:
+		walkList(v, n.Operands)
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+	v.Visit(nil)
+}
+
+func walkList(v Visitor, list []Node) {
+	for _, node := range list {
+		Walk(v, node)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a syntax tree in depth-first order. It starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a
+// call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,72 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cvilsmeier/bmatch/internal"
+)
+
+// foo OR NOT (bar AND /baz/)
+var testTree = &OrExpr{0, 26, []Node{
+	&StringLit{From: 0, To: 3, Value: "foo"},
+	&NotExpr{7, 26, &AndExpr{11, 26, []Node{
+		&StringLit{From: 12, To: 15, Value: "bar"},
+		&RegexLit{From: 20, To: 25, Pattern: "baz"},
+	}}},
+}}
+
+func dumpForTest(node Node) string {
+	switch n := node.(type) {
+	case nil:
+		return "nil"
+	case *StringLit:
+		return "'" + n.Value + "'"
+	case *RegexLit:
+		return "/" + n.Pattern + "/"
+	default:
+		return strings.TrimPrefix(fmt.Sprintf("%T", n), "*ast.")
+	}
+}
+
+type testVisitor struct {
+	visited *[]string
+}
+
+func (v testVisitor) Visit(node Node) Visitor {
+	*v.visited = append(*v.visited, dumpForTest(node))
+	if _, ok := node.(*NotExpr); ok {
+		return nil
+	}
+	return v
+}
+
+func TestWalk(t *testing.T) {
+	is := internal.Assert(t)
+	var visited []string
+	Walk(testVisitor{&visited}, testTree)
+	is.Eq("OrExpr 'foo' nil NotExpr nil", strings.Join(visited, " "))
+}
+
+func TestInspect(t *testing.T) {
+	is := internal.Assert(t)
+	var visited []string
+	Inspect(testTree, func(node Node) bool {
+		visited = append(visited, dumpForTest(node))
+		return true
+	})
+	is.Eq("OrExpr 'foo' nil NotExpr AndExpr 'bar' nil /baz/ nil nil nil nil", strings.Join(visited, " "))
+}
+
+func TestPositions(t *testing.T) {
+	is := internal.Assert(t)
+	var have []string
+	Inspect(testTree, func(node Node) bool {
+		if node != nil {
+			have = append(have, fmt.Sprintf("%d-%d", node.Pos(), node.End()))
+		}
+		return true
+	})
+	is.Eq("0-26 0-3 7-26 11-26 12-15 20-25", strings.Join(have, " "))
+}
@@ -2,134 +2,1712 @@
 package bmatch
 
 import (
+	"errors"
 	"fmt"
+	"iter"
+	"net/netip"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/cvilsmeier/bmatch/ast"
 	"github.com/cvilsmeier/bmatch/internal"
 )
 
 // A Matcher matches strings.
+//
+// The matchers returned by [Compile] also implement [fmt.Stringer]. Their
+// String method renders a bmatch expression that compiles to an equivalent
+// matcher.
 type Matcher interface {
 	Match(str string) bool
 }
 
+// A Span is a byte range [Start, End) of an input string.
+type Span struct {
+	Start int
+	End   int
+}
+
+// FindAll matches str and returns the byte ranges of str that were hit by
+// the string and regex literals contributing to the match. Literals below a
+// NOT operator never contribute. The ranges are sorted, overlapping ranges
+// are merged and empty ranges are left out.
+// If m does not match str, FindAll returns nil. If m matches without hitting
+// any range (e.g. for 'NOT foo'), FindAll returns an empty, non-nil slice.
+func FindAll(m Matcher, str string) []Span {
+	spans, ok := find(m, str, nil)
+	if !ok {
+		return nil
+	}
+	slices.SortFunc(spans, func(a, b Span) int {
+		if a.Start != b.Start {
+			return a.Start - b.Start
+		}
+		return a.End - b.End
+	})
+	merged := make([]Span, 0, len(spans))
+	for _, span := range spans {
+		if n := len(merged); n > 0 && span.Start < merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, span.End)
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// A finder is a Matcher that knows which parts of the input it matched.
+type finder interface {
+	// find appends the spans of str that made the matcher match to spans
+	// and reports whether it matched.
+	find(str string, spans []Span) ([]Span, bool)
+}
+
+// find is like finder.find but also accepts matchers that are not finders.
+func find(m Matcher, str string, spans []Span) ([]Span, bool) {
+	if f, ok := m.(finder); ok {
+		return f.find(str, spans)
+	}
+	return spans, m.Match(str)
+}
+
 // MustCompile is like Compile but panics on error.
 func MustCompile(expr string) Matcher {
 	m, err := Compile(expr)
 	if err != nil {
 		panic(fmt.Sprintf("bmatch: Compile(%q): %s", expr, err))
 	}
-	return m
+	return m
+}
+
+// Compile parses a bmatch expression and returns, if successful,
+// a [Matcher] object that can be used to match strings.
+func Compile(expr string) (Matcher, error) {
+	return CompileWithOptions(expr, Options{})
+}
+
+// Options control the compilation of expressions.
+// The zero value is valid and uses default limits.
+type Options struct {
+	// MaxTokens limits the number of tokens (literals, operators and
+	// parentheses) of an expression. If zero, it defaults to 1000.
+	MaxTokens int
+
+	// MaxDepth limits the nesting depth of an expression.
+	// Chains of AND and OR count as one level.
+	// If zero, it defaults to 20.
+	MaxDepth int
+
+	// MaxRegexSize limits the size of each regex literal, measured in
+	// instructions of the compiled regex program.
+	// If zero, the size of regex literals is not limited.
+	MaxRegexSize int
+
+	// MaxLiterals limits the number of string and regex literals, and
+	// function calls, of an expression. If zero, the number of literals is
+	// not limited.
+	MaxLiterals int
+
+	// RejectEmpty makes Compile fail for the empty expression,
+	// which otherwise matches every string.
+	RejectEmpty bool
+
+	// IgnoreCase makes all literals match case-insensitively, using
+	// Unicode case folding.
+	IgnoreCase bool
+
+	// WholeWords makes all string literals match whole words only, as if
+	// they had a 'word:' prefix. Regex literals are not affected.
+	WholeWords bool
+
+	// Glob makes string literals with unescaped '*' or '?' wildcards glob
+	// patterns, as if they had a 'glob:' prefix. To match a literal '*' or
+	// '?', escape or quote it, e.g. 'what\?' or '"what?"'.
+	Glob bool
+
+	// ImplicitAnd joins adjacent operands with an implicit AND, like
+	// search engines do: 'foo bar' is the same as 'foo AND bar'.
+	ImplicitAnd bool
+
+	// Dialect selects the operator spellings that are accepted.
+	Dialect Dialect
+
+	// Definitions are named sub-expressions that expressions can reference
+	// by name with a '$' prefix: with the definition 'noise' for
+	// 'healthcheck OR /GET \/metrics/', the expression 'error AND NOT $noise'
+	// is the same as 'error AND NOT (healthcheck OR /GET \/metrics/)'.
+	// Definitions can reference other definitions, but not themselves.
+	// If Definitions is nil, '$noise' is a string literal.
+	Definitions map[string]string
+
+	// Funcs are functions that expressions can call by name with a '@'
+	// prefix, with or without arguments, like '@iban' or '@vip(gold, silver)'.
+	// Arguments are separated by commas and can be quoted strings. Calling
+	// a function that is not in Funcs is an error. If Funcs is nil, '@iban'
+	// is a string literal.
+	Funcs map[string]Func
+
+	// Builtins enables the built-in functions, like '@ipv4' or '@uuid', see
+	// [BuiltinFuncs]. Funcs override built-in functions of the same name.
+	// With Builtins, '@iban' is a function call even if Funcs is nil.
+	Builtins bool
+}
+
+// A Func returns the matcher for a function call with the given arguments,
+// see Options.Funcs. It is called at compile time, once for each call, and
+// returns an error if the arguments are invalid. Its matcher does not report
+// match positions, so calls cannot be operands of NEAR, BEFORE and THEN.
+type Func func(args []string) (Matcher, error)
+
+// Predicate returns a Func for calls without arguments, whose matcher
+// matches if f returns true.
+func Predicate(f func(str string) bool) Func {
+	return func(args []string) (Matcher, error) {
+		if len(args) > 0 {
+			return nil, errors.New("too many arguments")
+		}
+		return MatcherFunc(f), nil
+	}
+}
+
+// A MatcherFunc is an ordinary function used as a [Matcher].
+type MatcherFunc func(str string) bool
+
+// Match returns f(str).
+func (f MatcherFunc) Match(str string) bool {
+	return f(str)
+}
+
+// A Dialect selects the operator spellings that expressions may use.
+type Dialect int
+
+const (
+	// DefaultDialect accepts the operators NOT, AND and OR.
+	DefaultDialect Dialect = iota
+
+	// ExtendedDialect additionally accepts the spellings '!', '&&' and '||',
+	// the lowercase keywords 'not', 'and', 'or', 'xor', 'implies', 'near/n',
+	// 'before/n', 'then', 'atleast', 'exactly' and 'atmost', and the
+	// Lucene-style prefixes '+' for required ('+foo' is 'foo') and '-' for
+	// excluded ('-foo' is 'NOT foo') operands. The prefixes are most useful
+	// together with ImplicitAnd: '+foo -bar' is 'foo AND NOT bar'.
+	// '&&' and '||' need no spaces around them, as in 'a&&b'.
+	// To match literals that start with '!', '+' or '-', that contain '&&'
+	// or '||', or that are keywords, escape or quote them, e.g. '\-5',
+	// '"a&&b"' or '"and"'.
+	ExtendedDialect
+)
+
+// defaultMaxDepth is the default for Options.MaxDepth.
+const defaultMaxDepth = 20
+
+// CompileWithOptions is like Compile but with options.
+func CompileWithOptions(expr string, opts Options) (Matcher, error) {
+	return newCompiler(opts).compile(expr)
+}
+
+// A Template is a prepared expression with placeholders, see [Prepare].
+type Template struct {
+	expr   string
+	opts   Options
+	params int
+}
+
+// Prepare parses a bmatch expression with '?' placeholders and returns, if
+// successful, a [Template] whose placeholders can be bound to values, e.g.
+// untrusted user input. A placeholder is an unescaped '?' in an unquoted
+// string literal, either standalone, like in 'user-id AND ?', or as part of
+// a literal, like in 'level:?'. Bound values are always part of a
+// single string literal, whatever characters they contain, so they can't
+// change the structure of the expression. An empty value for a standalone
+// placeholder is an error, because the empty literal would match every
+// input. To match a literal '?', escape or quote it, e.g. 'what\?' or
+// '"what?"'. In prepared expressions, glob patterns can't use the '?'
+// wildcard.
+func Prepare(expr string) (*Template, error) {
+	return PrepareWithOptions(expr, Options{})
+}
+
+// PrepareWithOptions is like Prepare but with options.
+func PrepareWithOptions(expr string, opts Options) (*Template, error) {
+	t := &Template{expr: expr, opts: opts}
+	c := newCompiler(opts)
+	c.bind = func(int) string {
+		t.params++
+		return "?"
+	}
+	if _, err := c.compile(expr); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NumParams returns the number of placeholders of t.
+func (t *Template) NumParams() int {
+	return t.params
+}
+
+// Bind replaces the placeholders of t with args, in order, and compiles
+// the result. The number of args must match the number of placeholders.
+func (t *Template) Bind(args ...string) (Matcher, error) {
+	if len(args) != t.params {
+		return nil, fmt.Errorf("got %d arguments for %d placeholders", len(args), t.params)
+	}
+	c := newCompiler(t.opts)
+	c.bind = func(i int) string { return args[i] }
+	return c.compile(t.expr)
+}
+
+// String returns the expression that t was prepared from.
+func (t *Template) String() string {
+	return t.expr
+}
+
+// QuoteLiteral returns a string literal that matches str literally, with
+// all options and in all dialects, e.g. 'a b' for "a b" and '"AND"' for
+// "AND". Expressions built from untrusted input should prefer [Prepare].
+func QuoteLiteral(str string) string {
+	return internal.QuoteString(str)
+}
+
+// Literal returns a matcher that matches if the input contains str, like
+// the string literal [QuoteLiteral](str).
+//
+// Literal, [Regex], [And], [Or] and [Not] build matchers without parsing an
+// expression. Their operands can be any matchers, including compiled ones.
+// Like compiled matchers, the results implement [fmt.Stringer]. Operands
+// that don't implement [fmt.Stringer] are rendered with [fmt.Sprint], and
+// then the result may not compile.
+func Literal(str string) Matcher {
+	return &stringMatcher{str}
+}
+
+// Regex returns a matcher that matches if rex matches the input, like a
+// regex literal.
+func Regex(rex *regexp.Regexp) Matcher {
+	return &regexMatcher{rex, rex.String(), ""}
+}
+
+// And returns a matcher that matches if all matchers match. Without
+// matchers, it matches every string, like the empty expression.
+func And(matchers ...Matcher) Matcher {
+	switch len(matchers) {
+	case 0:
+		return &stringMatcher{""}
+	case 1:
+		return matchers[0]
+	}
+	return &andMatcher{slices.Clone(matchers)}
+}
+
+// Or returns a matcher that matches if at least one of matchers matches.
+// Without matchers, it matches no string, like 'NOT ""'.
+func Or(matchers ...Matcher) Matcher {
+	switch len(matchers) {
+	case 0:
+		return &notMatcher{[]Matcher{&stringMatcher{""}}}
+	case 1:
+		return matchers[0]
+	}
+	return &orMatcher{slices.Clone(matchers)}
+}
+
+// Not returns a matcher that matches if m does not match.
+func Not(m Matcher) Matcher {
+	return &notMatcher{[]Matcher{m}}
+}
+
+// Explain parses a bmatch expression and returns, if successful,
+// a string representation of its syntax tree.
+func Explain(expr string) (string, error) {
+	return ExplainWithOptions(expr, Options{})
+}
+
+// ExplainWithOptions is like Explain but with options.
+// Options that only affect matching, like IgnoreCase, are not shown.
+func ExplainWithOptions(expr string, opts Options) (string, error) {
+	c := newCompiler(opts)
+	node, err := c.parse(expr)
+	if err != nil {
+		return "", err
+	}
+	return explainNode(0, node), nil
+}
+
+// A SyntaxError describes an error in a bmatch expression.
+type SyntaxError struct {
+	Expr     string   // the expression
+	Offset   int      // byte offset of the error in Expr
+	Column   int      // column of the error in Expr, counted in runes, starting at 1
+	Token    string   // the offending part of Expr, empty at the end of Expr
+	Msg      string   // description of the error
+	Expected []string // what would have been valid at Offset, may be empty
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at column %d: %s", e.Column, e.msg())
+}
+
+// msg returns the description of the error, including what was expected.
+func (e *SyntaxError) msg() string {
+	if len(e.Expected) > 0 {
+		return e.Msg + ", expected " + internal.DescribeExpected(e.Expected)
+	}
+	return e.Msg
+}
+
+// Caret renders the expression and, in a second line, a caret ('^')
+// that points at the error.
+func (e *SyntaxError) Caret() string {
+	return e.Expr + "\n" + strings.Repeat(" ", e.Column-1) + "^"
+}
+
+// newSyntaxError converts an internal syntax error to a [SyntaxError].
+// Other errors are returned unchanged.
+func newSyntaxError(expr string, err error) error {
+	var serr *internal.SyntaxError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	return &SyntaxError{
+		Expr:     expr,
+		Offset:   serr.Pos,
+		Column:   utf8.RuneCountInString(expr[:serr.Pos]) + 1,
+		Token:    expr[serr.Pos:serr.End],
+		Msg:      serr.Msg,
+		Expected: serr.Expected,
+	}
+}
+
+// ParseExpr parses a bmatch expression and returns, if successful,
+// its syntax tree.
+func ParseExpr(expr string) (ast.Node, error) {
+	return ParseExprWithOptions(expr, Options{})
+}
+
+// ParseExprWithOptions is like ParseExpr but with options.
+func ParseExprWithOptions(expr string, opts Options) (ast.Node, error) {
+	c := newCompiler(opts)
+	return c.parse(expr)
+}
+
+// A compiler compiles expressions to matchers.
+type compiler struct {
+	opts Options
+	defs map[string]ast.Node // parsed definitions, by name
+	bind func(i int) string  // the values of placeholders, nil if there are none
+}
+
+func newCompiler(opts Options) *compiler {
+	return &compiler{opts: opts, defs: make(map[string]ast.Node)}
+}
+
+// lookup returns the function with the given name.
+func (c *compiler) lookup(name string) (Func, bool) {
+	if f, ok := c.opts.Funcs[name]; ok {
+		return f, true
+	}
+	if c.opts.Builtins {
+		return lookupBuiltin(name)
+	}
+	return nil, false
+}
+
+// compile parses and builds an expression.
+func (c *compiler) compile(expr string) (Matcher, error) {
+	node, err := c.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.build(0, node)
+	if err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	return m, nil
+}
+
+// parse parses an expression and checks it against the limits in c.opts.
+func (c *compiler) parse(expr string) (ast.Node, error) {
+	node, err := c.parseExpr(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.check(node); err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	return node, nil
+}
+
+// parseExpr parses an expression and resolves its references. names are
+// the definitions that are being parsed, the innermost last.
+func (c *compiler) parseExpr(expr string, names []string) (ast.Node, error) {
+	lexOpts := internal.LexOptions{
+		Extended: c.opts.Dialect == ExtendedDialect,
+		Glob:     c.opts.Glob,
+		Refs:     c.opts.Definitions != nil,
+		Funcs:    c.opts.Funcs != nil || c.opts.Builtins,
+	}
+	if len(names) == 0 {
+		// definitions have no placeholders
+		lexOpts.Bind = c.bind
+	}
+	lex, err := internal.NewStringLexerWithOptions(expr, lexOpts)
+	if err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	inode, err := internal.ParseWithOptions(lex, internal.ParseOptions{
+		MaxTokens:   c.opts.MaxTokens,
+		ImplicitAnd: c.opts.ImplicitAnd,
+	})
+	if err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	node := toAST(inode)
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.RefExpr:
+			err = c.resolve(n, names)
+		case *ast.CallExpr:
+			if _, ok := c.lookup(n.Name); !ok {
+				err = &internal.SyntaxError{Pos: n.From, End: n.To, Msg: fmt.Sprintf("unknown function @%s", n.Name)}
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	// the operands are checked after their references are resolved
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.NearExpr:
+			op := fmt.Sprintf("NEAR/%d", n.Distance)
+			if n.Ordered {
+				op = fmt.Sprintf("BEFORE/%d", n.Distance)
+			}
+			err = c.checkPositional(op, []ast.Node{n.X, n.Y})
+		case *ast.ThenExpr:
+			err = c.checkPositional("THEN", n.Operands)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, newSyntaxError(expr, err)
+	}
+	return node, nil
+}
+
+// checkPositional checks that each match of the operands of op has a
+// position. Without positions, op could never match, and the spans of a
+// composite operand like 'a AND b' are not the positions of its matches.
+func (c *compiler) checkPositional(op string, operands []ast.Node) error {
+	for _, node := range operands {
+		if !c.positional(node) {
+			return &internal.SyntaxError{Pos: node.Pos(), End: node.End(), Msg: fmt.Sprintf("invalid operand %s of %s: it must be a literal or an OR of literals that match non-empty text", node, op)}
+		}
+	}
+	return nil
+}
+
+// positional reports whether node is a literal, or an OR of literals,
+// whose matches each report the position of a non-empty match.
+func (c *compiler) positional(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.StringLit:
+		return n.Value != ""
+	case *ast.RegexLit:
+		re, err := syntax.Parse(n.Pattern, syntax.Perl)
+		// invalid regexes are reported when building
+		return err != nil || minLength(re) > 0
+	case *ast.GlobLit:
+		segments, err := parseGlob(n.Pattern)
+		return err != nil || slices.ContainsFunc(segments, func(s globSegment) bool { return len(s.runes) > 0 })
+	case *ast.CountExpr:
+		return n.Min > 0 && c.positional(n.X)
+	case *ast.RefExpr:
+		return c.positional(n.X)
+	case *ast.CallExpr:
+		// the matchers of built-in functions report positions, the
+		// matchers of Funcs may not
+		_, ok := c.opts.Funcs[n.Name]
+		return !ok
+	case *ast.OrExpr:
+		return c.allPositional(n.Operands)
+	}
+	// NOT and IMPLIES match without positions, the other operators report
+	// the positions of their operands, not of their matches
+	return false
+}
+
+// allPositional reports whether all nodes are positional.
+func (c *compiler) allPositional(nodes []ast.Node) bool {
+	for _, node := range nodes {
+		if !c.positional(node) {
+			return false
+		}
+	}
+	return true
+}
+
+// minLength returns the minimum number of characters that re matches.
+func minLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return 1
+	case syntax.OpCapture, syntax.OpPlus:
+		return minLength(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min * minLength(re.Sub[0])
+	case syntax.OpConcat:
+		n := 0
+		for _, sub := range re.Sub {
+			n += minLength(sub)
+		}
+		return n
+	case syntax.OpAlternate:
+		n := minLength(re.Sub[0])
+		for _, sub := range re.Sub[1:] {
+			n = min(n, minLength(sub))
+		}
+		return n
+	}
+	// empty matches, anchors, and '*' and '?' repetitions
+	return 0
+}
+
+// resolve parses the definition that ref refers to, and stores it in ref.X.
+func (c *compiler) resolve(ref *ast.RefExpr, names []string) error {
+	if i := slices.Index(names, ref.Name); i >= 0 {
+		cycle := "$" + strings.Join(append(names[i:], ref.Name), " -> $")
+		return &internal.SyntaxError{Pos: ref.From, End: ref.To, Msg: "cyclic definition " + cycle}
+	}
+	if node, ok := c.defs[ref.Name]; ok {
+		ref.X = node
+		return nil
+	}
+	def, ok := c.opts.Definitions[ref.Name]
+	if !ok {
+		return &internal.SyntaxError{Pos: ref.From, End: ref.To, Msg: "undefined name $" + ref.Name}
+	}
+	node, err := c.parseExpr(def, append(names[:len(names):len(names)], ref.Name))
+	if err != nil {
+		return definitionError(ref, err)
+	}
+	c.defs[ref.Name] = node
+	ref.X = node
+	return nil
+}
+
+// definitionError converts an error in the definition that ref refers
+// to into an error at ref.
+func definitionError(ref *ast.RefExpr, err error) error {
+	var serr *SyntaxError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	msg := fmt.Sprintf("in $%s at column %d: %s", ref.Name, serr.Column, serr.msg())
+	return &internal.SyntaxError{Pos: ref.From, End: ref.To, Msg: msg}
+}
+
+// check checks the limits in c.opts that can be checked before building matchers.
+func (c *compiler) check(node ast.Node) error {
+	if lit, ok := node.(*ast.StringLit); ok && lit.From == lit.To && c.opts.RejectEmpty {
+		return &internal.SyntaxError{Pos: lit.From, End: lit.To, Msg: "empty expression"}
+	}
+	if c.opts.MaxLiterals > 0 {
+		var err error
+		count := 0
+		ast.Inspect(node, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.StringLit, *ast.RegexLit, *ast.GlobLit, *ast.CallExpr:
+				count++
+			case *ast.RefExpr:
+				// the literals of a definition count at the reference,
+				// because their positions are not in the expression
+				count += countLiterals(n.X)
+			default:
+				return err == nil
+			}
+			if count > c.opts.MaxLiterals && err == nil {
+				err = &internal.SyntaxError{Pos: node.Pos(), End: node.End(), Msg: fmt.Sprintf("too many literals, maximum is %d", c.opts.MaxLiterals)}
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countLiterals returns the number of string, regex and glob literals,
+// and function calls, in node.
+func countLiterals(node ast.Node) int {
+	count := 0
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.StringLit, *ast.RegexLit, *ast.GlobLit, *ast.CallExpr:
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// toAST converts an internal parse tree to a public syntax tree.
+func toAST(node internal.Node) ast.Node {
+	if node.Count != "" {
+		// the lexer checked that the count is valid
+		lo, hi, _ := internal.ParseCount(node.Count)
+		lit := node
+		lit.Count = ""
+		lit.End -= len(node.Count) + 2 // without braces
+		return &ast.CountExpr{From: node.Pos, To: node.End, X: toAST(lit), Min: lo, Max: hi}
+	}
+	var subnodes []ast.Node
+	for _, subnode := range node.Subnodes {
+		subnodes = append(subnodes, toAST(subnode))
+	}
+	switch node.Typ {
+	case internal.StringNode:
+		if strings.Contains(node.Flags, "g") {
+			return &ast.GlobLit{
+				From:        node.Pos,
+				To:          node.End,
+				Pattern:     node.Text,
+				IgnoreCase:  strings.Contains(node.Flags, "i"),
+				AnchorStart: strings.Contains(node.Flags, "^"),
+				AnchorEnd:   strings.Contains(node.Flags, "$"),
+			}
+		}
+		return &ast.StringLit{
+			From:        node.Pos,
+			To:          node.End,
+			Value:       node.Text,
+			IgnoreCase:  strings.Contains(node.Flags, "i"),
+			WholeWord:   strings.Contains(node.Flags, "w"),
+			AnchorStart: strings.Contains(node.Flags, "^"),
+			AnchorEnd:   strings.Contains(node.Flags, "$"),
+		}
+	case internal.RegexNode:
+		return &ast.RegexLit{From: node.Pos, To: node.End, Pattern: node.Text, Flags: node.Flags}
+	case internal.RefNode:
+		// the definition is resolved later
+		return &ast.RefExpr{From: node.Pos, To: node.End, Name: node.Text}
+	case internal.FuncNode:
+		return &ast.CallExpr{From: node.Pos, To: node.End, Name: node.Text, Args: node.Args}
+	case internal.NotNode:
+		return &ast.NotExpr{From: node.Pos, To: node.End, X: subnodes[0]}
+	case internal.AndNode:
+		return &ast.AndExpr{From: node.Pos, To: node.End, Operands: subnodes}
+	case internal.OrNode:
+		return &ast.OrExpr{From: node.Pos, To: node.End, Operands: subnodes}
+	case internal.XorNode:
+		return &ast.XorExpr{From: node.Pos, To: node.End, Operands: subnodes}
+	case internal.ImpliesNode:
+		return &ast.ImpliesExpr{From: node.Pos, To: node.End, X: subnodes[0], Y: subnodes[1]}
+	case internal.NearNode, internal.BeforeNode:
+		// the lexer checked that the distance is a valid number
+		distance, _ := strconv.Atoi(node.Text[strings.IndexByte(node.Text, '/')+1:])
+		return &ast.NearExpr{From: node.Pos, To: node.End, X: subnodes[0], Y: subnodes[1], Distance: distance, Ordered: node.Typ == internal.BeforeNode}
+	case internal.ThenNode:
+		return &ast.ThenExpr{From: node.Pos, To: node.End, Operands: subnodes}
+	case internal.ThresholdNode:
+		// the lexer checked that the count is a valid number
+		op, count, _ := strings.Cut(node.Text, " ")
+		k, _ := strconv.Atoi(count)
+		return &ast.ThresholdExpr{From: node.Pos, To: node.End, Op: strings.ToUpper(op), Count: k, Operands: subnodes}
+	default:
+		panic("bad node typ")
+	}
+}
+
+func explainNode(level int, node ast.Node) string {
+	var str string
+	var subnodes []ast.Node
+	switch n := node.(type) {
+	case *ast.StringLit:
+		str = "'" + n.Value + "'"
+		if n.AnchorStart {
+			str = "^" + str
+		}
+		if n.AnchorEnd {
+			str += "$"
+		}
+		if n.IgnoreCase {
+			str += "i"
+		}
+		if n.WholeWord {
+			str += "w"
+		}
+	case *ast.RegexLit:
+		str = "/" + n.Pattern + "/" + n.Flags
+	case *ast.GlobLit:
+		str = "'" + n.Pattern + "'"
+		if n.AnchorStart {
+			str = "^" + str
+		}
+		if n.AnchorEnd {
+			str += "$"
+		}
+		if n.IgnoreCase {
+			str += "i"
+		}
+		str += "g"
+	case *ast.CountExpr:
+		str = explainNode(level+1, n.X) + internal.FormatCount(n.Min, n.Max)
+	case *ast.RefExpr:
+		// references are shown expanded
+		str = explainNode(level, n.X)
+	case *ast.CallExpr:
+		str = n.String()
+	case *ast.NotExpr:
+		str = "NOT"
+		subnodes = []ast.Node{n.X}
+	case *ast.AndExpr:
+		str = "AND"
+		subnodes = n.Operands
+	case *ast.OrExpr:
+		str = "OR"
+		subnodes = n.Operands
+	case *ast.XorExpr:
+		str = "XOR"
+		subnodes = n.Operands
+	case *ast.ImpliesExpr:
+		str = "IMPLIES"
+		subnodes = []ast.Node{n.X, n.Y}
+	case *ast.NearExpr:
+		str = fmt.Sprintf("NEAR/%d", n.Distance)
+		if n.Ordered {
+			str = fmt.Sprintf("BEFORE/%d", n.Distance)
+		}
+		subnodes = []ast.Node{n.X, n.Y}
+	case *ast.ThenExpr:
+		str = "THEN"
+		subnodes = n.Operands
+	case *ast.ThresholdExpr:
+		str = fmt.Sprintf("%s %d", n.Op, n.Count)
+		subnodes = n.Operands
+	default:
+		panic("bad node type")
+	}
+	if len(subnodes) > 0 {
+		str += "["
+		for i, child := range subnodes {
+			if i > 0 {
+				str += ","
+			}
+			str += explainNode(level+1, child)
+		}
+		str += "]"
+	}
+	return str
+}
+
+func (c *compiler) build(level int, node ast.Node) (Matcher, error) {
+	maxDepth := c.opts.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if level > maxDepth {
+		return nil, &internal.SyntaxError{Pos: node.Pos(), End: node.End(), Msg: fmt.Sprintf("too deep nesting level %d", level)}
+	}
+	switch n := node.(type) {
+	case *ast.StringLit:
+		fold := c.opts.IgnoreCase || n.IgnoreCase
+		word := (c.opts.WholeWords || n.WholeWord) && n.Value != ""
+		switch {
+		case n.AnchorStart && n.AnchorEnd:
+			return &exactMatcher{n.Value, fold}, nil
+		case n.AnchorStart:
+			return &prefixMatcher{n.Value, fold, word}, nil
+		case n.AnchorEnd:
+			return &suffixMatcher{n.Value, fold, word}, nil
+		case word:
+			return &wordMatcher{n.Value, fold}, nil
+		case fold:
+			return &foldMatcher{n.Value}, nil
+		}
+		return &stringMatcher{n.Value}, nil
+	case *ast.RegexLit:
+		flags := n.Flags
+		if c.opts.IgnoreCase && !strings.Contains(flags, "i") {
+			flags += "i"
+		}
+		pattern := n.Pattern
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		rex, err := c.compileRegex(pattern)
+		if err != nil {
+			return nil, &internal.SyntaxError{Pos: n.From, End: n.To, Msg: err.Error()}
+		}
+		return &regexMatcher{rex, n.Pattern, flags}, nil
+	case *ast.GlobLit:
+		segments, err := parseGlob(n.Pattern)
+		if err != nil {
+			return nil, &internal.SyntaxError{Pos: n.From, End: n.To, Msg: err.Error()}
+		}
+		// without anchors, leading and trailing '*' don't change the result
+		if !n.AnchorStart && len(segments) > 1 && len(segments[0].runes) == 0 {
+			segments = segments[1:]
+		}
+		if !n.AnchorEnd && len(segments) > 1 && len(segments[len(segments)-1].runes) == 0 {
+			segments = segments[:len(segments)-1]
+		}
+		return &globMatcher{n.Pattern, segments, c.opts.IgnoreCase || n.IgnoreCase, n.AnchorStart, n.AnchorEnd}, nil
+	case *ast.CountExpr:
+		submatchers, err := c.buildAll(level, []ast.Node{n.X})
+		if err != nil {
+			return nil, err
+		}
+		return &countMatcher{submatchers[0], n.Min, n.Max}, nil
+	case *ast.RefExpr:
+		// references are transparent, but errors must point into the expression
+		m, err := c.build(level, n.X)
+		if err != nil {
+			return nil, definitionError(n, newSyntaxError(c.opts.Definitions[n.Name], err))
+		}
+		return m, nil
+	case *ast.CallExpr:
+		f, _ := c.lookup(n.Name)
+		m, err := f(n.Args)
+		if err != nil {
+			return nil, &internal.SyntaxError{Pos: n.From, End: n.To, Msg: fmt.Sprintf("invalid call %s: %v", n, err)}
+		}
+		return &funcMatcher{n.Name, n.Args, m}, nil
+	case *ast.NotExpr:
+		submatchers, err := c.buildAll(level, []ast.Node{n.X})
+		if err != nil {
+			return nil, err
+		}
+		return &notMatcher{submatchers}, nil
+	case *ast.AndExpr:
+		submatchers, err := c.buildAll(level, n.Operands)
+		if err != nil {
+			return nil, err
+		}
+		return &andMatcher{submatchers}, nil
+	case *ast.OrExpr:
+		submatchers, err := c.buildAll(level, n.Operands)
+		if err != nil {
+			return nil, err
+		}
+		return &orMatcher{submatchers}, nil
+	case *ast.XorExpr:
+		submatchers, err := c.buildAll(level, n.Operands)
+		if err != nil {
+			return nil, err
+		}
+		return &xorMatcher{submatchers}, nil
+	case *ast.ImpliesExpr:
+		submatchers, err := c.buildAll(level, []ast.Node{n.X, n.Y})
+		if err != nil {
+			return nil, err
+		}
+		return &impliesMatcher{submatchers[0], submatchers[1]}, nil
+	case *ast.NearExpr:
+		submatchers, err := c.buildAll(level, []ast.Node{n.X, n.Y})
+		if err != nil {
+			return nil, err
+		}
+		return &nearMatcher{submatchers[0], submatchers[1], n.Distance, n.Ordered}, nil
+	case *ast.ThenExpr:
+		submatchers, err := c.buildAll(level, n.Operands)
+		if err != nil {
+			return nil, err
+		}
+		return &thenMatcher{submatchers}, nil
+	case *ast.ThresholdExpr:
+		if n.Count > len(n.Operands) {
+			return nil, &internal.SyntaxError{Pos: n.From, End: n.To, Msg: fmt.Sprintf("count %d exceeds number of operands %d", n.Count, len(n.Operands))}
+		}
+		submatchers, err := c.buildAll(level, n.Operands)
+		if err != nil {
+			return nil, err
+		}
+		return &thresholdMatcher{n.Op, n.Count, submatchers}, nil
+	default:
+		panic("bad node type")
+	}
+}
+
+func (c *compiler) buildAll(level int, nodes []ast.Node) ([]Matcher, error) {
+	var matchers []Matcher
+	for _, node := range nodes {
+		m, err := c.build(level+1, node)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// compileRegex compiles a regex and checks its size against c.opts.MaxRegexSize.
+func (c *compiler) compileRegex(pattern string) (*regexp.Regexp, error) {
+	if c.opts.MaxRegexSize > 0 {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			return nil, err
+		}
+		if len(prog.Inst) > c.opts.MaxRegexSize {
+			return nil, fmt.Errorf("regex too large, size is %d, maximum is %d", len(prog.Inst), c.opts.MaxRegexSize)
+		}
+	}
+	return regexp.Compile(pattern)
+}
+
+// operand renders a matcher as operand of an operator with precedence opPrec.
+func operand(m Matcher, opPrec int) string {
+	prec := internal.LiteralPrec
+	if p, ok := m.(interface{ precedence() int }); ok {
+		prec = p.precedence()
+	}
+	return internal.Paren(fmt.Sprint(m), prec, opPrec)
+}
+
+// join renders matchers as operands of an operator.
+func join(matchers []Matcher, sep string, opPrec int) string {
+	strs := make([]string, len(matchers))
+	for i, m := range matchers {
+		strs[i] = operand(m, opPrec)
+	}
+	return strings.Join(strs, sep)
+}
+
+// A stringMatcher matches if the input contains a given string.
+type stringMatcher struct {
+	str string
+}
+
+func (m *stringMatcher) Match(str string) bool {
+	return strings.Contains(str, m.str)
+}
+
+func (m *stringMatcher) String() string {
+	return internal.QuoteString(m.str)
+}
+
+func (m *stringMatcher) find(str string, spans []Span) ([]Span, bool) {
+	if m.str == "" {
+		return spans, true
+	}
+	found := false
+	offset := 0
+	for {
+		i := strings.Index(str[offset:], m.str)
+		if i < 0 {
+			return spans, found
+		}
+		found = true
+		start := offset + i
+		offset = start + len(m.str)
+		spans = append(spans, Span{start, offset})
+	}
+}
+
+// A foldMatcher matches if the input contains a given string,
+// ignoring case.
+type foldMatcher struct {
+	str string
+}
+
+func (m *foldMatcher) Match(str string) bool {
+	_, _, ok := indexFold(str, m.str)
+	return ok
+}
+
+func (m *foldMatcher) String() string {
+	return internal.QuoteFlaggedString(m.str, "i")
+}
+
+func (m *foldMatcher) find(str string, spans []Span) ([]Span, bool) {
+	found := false
+	offset := 0
+	for offset < len(str) {
+		start, end, ok := indexFold(str[offset:], m.str)
+		if !ok || start == end {
+			break
+		}
+		found = true
+		spans = append(spans, Span{offset + start, offset + end})
+		offset += end
+	}
+	return spans, found || m.str == ""
+}
+
+// indexFold returns the byte range of the first instance of substr in s,
+// under Unicode case folding. The range may differ in length from substr,
+// e.g. for 'K' and the Kelvin sign.
+func indexFold(s, substr string) (int, int, bool) {
+	if substr == "" {
+		return 0, 0, true
+	}
+	for i := 0; i < len(s); {
+		if n, ok := hasPrefixFold(s[i:], substr); ok {
+			return i, i + n, true
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return 0, 0, false
+}
+
+// hasPrefixFold reports whether s begins with prefix under Unicode case
+// folding, and if so, the length of that beginning in bytes.
+func hasPrefixFold(s, prefix string) (int, bool) {
+	n := 0
+	for _, pr := range prefix {
+		if n >= len(s) {
+			return 0, false
+		}
+		sr, size := utf8.DecodeRuneInString(s[n:])
+		if !equalFold(sr, pr) {
+			return 0, false
+		}
+		n += size
+	}
+	return n, true
+}
+
+// equalFold reports whether two runes are equal under Unicode case folding.
+func equalFold(r1, r2 rune) bool {
+	if r1 == r2 {
+		return true
+	}
+	if r1 < utf8.RuneSelf && r2 < utf8.RuneSelf {
+		// fast path for ASCII
+		if 'A' <= r1 && r1 <= 'Z' {
+			r1 += 'a' - 'A'
+		}
+		if 'A' <= r2 && r2 <= 'Z' {
+			r2 += 'a' - 'A'
+		}
+		return r1 == r2
+	}
+	for r := unicode.SimpleFold(r1); r != r1; r = unicode.SimpleFold(r) {
+		if r == r2 {
+			return true
+		}
+	}
+	return false
+}
+
+// A wordMatcher matches if the input contains a given string as a whole
+// word, that is, neither preceded nor followed by a word character.
+type wordMatcher struct {
+	str  string
+	fold bool // ignore case
+}
+
+func (m *wordMatcher) Match(str string) bool {
+	_, _, ok := m.index(str)
+	return ok
+}
+
+func (m *wordMatcher) String() string {
+	return internal.QuoteFlaggedString(m.str, stringFlags(m.fold, true))
+}
+
+func (m *wordMatcher) find(str string, spans []Span) ([]Span, bool) {
+	found := false
+	offset := 0
+	for offset < len(str) {
+		start, end, ok := m.index(str[offset:])
+		if !ok {
+			break
+		}
+		found = true
+		spans = append(spans, Span{offset + start, offset + end})
+		offset += end
+	}
+	return spans, found
+}
+
+// index returns the byte range of the first whole-word instance of m.str in s.
+func (m *wordMatcher) index(s string) (int, int, bool) {
+	for offset := 0; offset < len(s); {
+		var start, end int
+		if m.fold {
+			var ok bool
+			start, end, ok = indexFold(s[offset:], m.str)
+			if !ok {
+				return 0, 0, false
+			}
+		} else {
+			start = strings.Index(s[offset:], m.str)
+			if start < 0 {
+				return 0, 0, false
+			}
+			end = start + len(m.str)
+		}
+		start += offset
+		end += offset
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordChar(before) && !isWordChar(after) {
+			return start, end, true
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		offset = start + size
+	}
+	return 0, 0, false
+}
+
+// isWordChar reports whether r is a letter, mark, digit or underscore.
+// It reports false for utf8.RuneError, which is returned at the start and
+// end of the input.
+func isWordChar(r rune) bool {
+	if r == utf8.RuneError {
+		return false
+	}
+	return r == '_' || unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r)
+}
+
+// stringFlags returns the lexer flags of a string literal.
+func stringFlags(fold, word bool) string {
+	var flags string
+	if fold {
+		flags += "i"
+	}
+	if word {
+		flags += "w"
+	}
+	return flags
+}
+
+// A prefixMatcher matches if the input starts with a given string.
+type prefixMatcher struct {
+	str  string
+	fold bool // ignore case
+	word bool // the string must not be followed by a word character
+}
+
+func (m *prefixMatcher) Match(str string) bool {
+	_, ok := m.match(str)
+	return ok
+}
+
+func (m *prefixMatcher) String() string {
+	return internal.QuoteFlaggedString(m.str, stringFlags(m.fold, m.word)+"^")
+}
+
+func (m *prefixMatcher) find(str string, spans []Span) ([]Span, bool) {
+	end, ok := m.match(str)
+	if ok && end > 0 {
+		spans = append(spans, Span{0, end})
+	}
+	return spans, ok
+}
+
+// match returns the end of the prefix in str.
+func (m *prefixMatcher) match(str string) (int, bool) {
+	end := len(m.str)
+	if m.fold {
+		var ok bool
+		if end, ok = hasPrefixFold(str, m.str); !ok {
+			return 0, false
+		}
+	} else if !strings.HasPrefix(str, m.str) {
+		return 0, false
+	}
+	if m.word {
+		if r, _ := utf8.DecodeRuneInString(str[end:]); isWordChar(r) {
+			return 0, false
+		}
+	}
+	return end, true
+}
+
+// A suffixMatcher matches if the input ends with a given string.
+type suffixMatcher struct {
+	str  string
+	fold bool // ignore case
+	word bool // the string must not be preceded by a word character
+}
+
+func (m *suffixMatcher) Match(str string) bool {
+	_, ok := m.match(str)
+	return ok
+}
+
+func (m *suffixMatcher) String() string {
+	return internal.QuoteFlaggedString(m.str, stringFlags(m.fold, m.word)+"$")
+}
+
+func (m *suffixMatcher) find(str string, spans []Span) ([]Span, bool) {
+	start, ok := m.match(str)
+	if ok && start < len(str) {
+		spans = append(spans, Span{start, len(str)})
+	}
+	return spans, ok
+}
+
+// match returns the start of the suffix in str.
+func (m *suffixMatcher) match(str string) (int, bool) {
+	start := len(str) - len(m.str)
+	if m.fold {
+		// simple case folding maps runes to runes, so the suffix
+		// has as many runes as m.str
+		start = len(str)
+		for range utf8.RuneCountInString(m.str) {
+			if start == 0 {
+				return 0, false
+			}
+			_, size := utf8.DecodeLastRuneInString(str[:start])
+			start -= size
+		}
+		if n, ok := hasPrefixFold(str[start:], m.str); !ok || start+n != len(str) {
+			return 0, false
+		}
+	} else if !strings.HasSuffix(str, m.str) {
+		return 0, false
+	}
+	if m.word {
+		if r, _ := utf8.DecodeLastRuneInString(str[:start]); isWordChar(r) {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+// An exactMatcher matches if the input equals a given string.
+type exactMatcher struct {
+	str  string
+	fold bool // ignore case
+}
+
+func (m *exactMatcher) Match(str string) bool {
+	if m.fold {
+		n, ok := hasPrefixFold(str, m.str)
+		return ok && n == len(str)
+	}
+	return str == m.str
+}
+
+func (m *exactMatcher) String() string {
+	return internal.QuoteFlaggedString(m.str, stringFlags(m.fold, false)+"^$")
+}
+
+func (m *exactMatcher) find(str string, spans []Span) ([]Span, bool) {
+	ok := m.Match(str)
+	if ok && str != "" {
+		spans = append(spans, Span{0, len(str)})
+	}
+	return spans, ok
+}
+
+// anyRune is the '?' wildcard in a glob segment.
+const anyRune = -1
+
+// A globSegment is a part of a glob pattern between '*' wildcards.
+type globSegment struct {
+	runes []rune
+	str   string // the runes as string, if there is no '?' wildcard
+	plain bool   // there is no '?' wildcard
+}
+
+// parseGlob splits a glob pattern at '*' wildcards into segments.
+func parseGlob(pattern string) ([]globSegment, error) {
+	var segments []globSegment
+	var runes []rune
+	plain := true
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			runes = append(runes, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			segments = append(segments, globSegment{runes, string(runes), plain})
+			runes, plain = nil, true
+		case r == '?':
+			runes = append(runes, anyRune)
+			plain = false
+		default:
+			runes = append(runes, r)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("invalid glob pattern %q: trailing backslash", pattern)
+	}
+	return append(segments, globSegment{runes, string(runes), plain}), nil
+}
+
+// A globMatcher matches if the input contains a string that matches
+// a glob pattern. The pattern is split into segments at '*' wildcards,
+// and each segment is matched at the leftmost possible position.
+type globMatcher struct {
+	pattern     string
+	segments    []globSegment
+	fold        bool // ignore case
+	anchorStart bool
+	anchorEnd   bool
+}
+
+func (m *globMatcher) Match(str string) bool {
+	_, _, ok := m.index(str)
+	return ok
+}
+
+func (m *globMatcher) String() string {
+	flags := "g"
+	if m.fold {
+		flags = "ig"
+	}
+	if m.anchorStart {
+		flags += "^"
+	}
+	if m.anchorEnd {
+		flags += "$"
+	}
+	return internal.QuoteFlaggedString(m.pattern, flags)
+}
+
+func (m *globMatcher) find(str string, spans []Span) ([]Span, bool) {
+	found := false
+	offset := 0
+	for {
+		start, end, ok := m.index(str[offset:])
+		if !ok {
+			return spans, found
+		}
+		found = true
+		if start == end {
+			return spans, found
+		}
+		spans = append(spans, Span{offset + start, offset + end})
+		offset += end
+		if m.anchorStart || m.anchorEnd || offset == len(str) {
+			return spans, found
+		}
+	}
+}
+
+// index returns the byte range of the first match in s.
+func (m *globMatcher) index(s string) (int, int, bool) {
+	first := m.segments[0]
+	last := m.segments[len(m.segments)-1]
+	if len(m.segments) == 1 && m.anchorEnd {
+		start, ok := m.suffixStart(s, last)
+		if !ok || m.anchorStart && start != 0 {
+			return 0, 0, false
+		}
+		return start, len(s), true
+	}
+	var start, end int
+	if m.anchorStart {
+		n, ok := m.hasPrefix(s, first)
+		if !ok {
+			return 0, 0, false
+		}
+		end = n
+	} else {
+		var ok bool
+		if start, end, ok = m.indexSegment(s, first); !ok {
+			return 0, 0, false
+		}
+	}
+	if len(m.segments) == 1 {
+		return start, end, true
+	}
+	for _, segment := range m.segments[1 : len(m.segments)-1] {
+		_, n, ok := m.indexSegment(s[end:], segment)
+		if !ok {
+			return 0, 0, false
+		}
+		end += n
+	}
+	if m.anchorEnd {
+		lastStart, ok := m.suffixStart(s, last)
+		if !ok || lastStart < end {
+			return 0, 0, false
+		}
+		return start, len(s), true
+	}
+	_, n, ok := m.indexSegment(s[end:], last)
+	if !ok {
+		return 0, 0, false
+	}
+	return start, end + n, true
 }
 
-// Compile parses a bmatch expression and returns, if successful,
-// a [Matcher] object that can be used to match strings.
-func Compile(expr string) (Matcher, error) {
-	node, err := compileNode(expr)
-	if err != nil {
-		return nil, err
+// indexSegment returns the byte range of the first instance of segment in s.
+func (m *globMatcher) indexSegment(s string, segment globSegment) (int, int, bool) {
+	if segment.plain && !m.fold {
+		i := strings.Index(s, segment.str)
+		return i, i + len(segment.str), i >= 0
+	}
+	for i := 0; i <= len(s); {
+		if n, ok := m.hasPrefix(s[i:], segment); ok {
+			return i, i + n, true
+		}
+		if i == len(s) {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
 	}
-	return buildMatcher(0, node)
+	return 0, 0, false
 }
 
-// Explain parses a bmatch expression and returns, if successful,
-// a string representation of its syntax tree.
-func Explain(expr string) (string, error) {
-	node, err := compileNode(expr)
-	if err != nil {
-		return "", err
+// suffixStart returns the start of segment in s, if s ends with segment.
+func (m *globMatcher) suffixStart(s string, segment globSegment) (int, bool) {
+	// segments match rune by rune, so the suffix has as many runes as segment
+	start := len(s)
+	for range segment.runes {
+		if start == 0 {
+			return 0, false
+		}
+		_, size := utf8.DecodeLastRuneInString(s[:start])
+		start -= size
 	}
-	return explainNode(0, node), nil
+	_, ok := m.hasPrefix(s[start:], segment)
+	return start, ok
 }
 
-func compileNode(expr string) (internal.Node, error) {
-	lex, err := internal.NewStringLexer(expr)
-	if err != nil {
-		return internal.Node{}, err
+// hasPrefix reports whether s begins with segment, and if so,
+// the length of that beginning in bytes.
+func (m *globMatcher) hasPrefix(s string, segment globSegment) (int, bool) {
+	n := 0
+	for _, pr := range segment.runes {
+		if n >= len(s) {
+			return 0, false
+		}
+		sr, size := utf8.DecodeRuneInString(s[n:])
+		if pr != anyRune && sr != pr && !(m.fold && equalFold(sr, pr)) {
+			return 0, false
+		}
+		n += size
 	}
-	return internal.Parse(lex)
+	return n, true
 }
 
-func explainNode(level int, node internal.Node) string {
-	var str string
-	switch node.Typ {
-	case internal.StringNode:
-		str = "'" + node.Text + "'"
-	case internal.RegexNode:
-		str = "/" + node.Text + "/"
-	case internal.NotNode:
-		str = "NOT"
-	case internal.AndNode:
-		str = "AND"
-	case internal.OrNode:
-		str = "OR"
-	default:
-		panic("bad node typ")
+// A regexMatcher matches if the input matches a given regular expression.
+type regexMatcher struct {
+	rex     *regexp.Regexp
+	pattern string // pattern without flags
+	flags   string
+}
+
+func (m *regexMatcher) Match(str string) bool {
+	return m.rex.MatchString(str)
+}
+
+func (m *regexMatcher) String() string {
+	return internal.QuoteRegex(m.pattern) + m.flags
+}
+
+func (m *regexMatcher) find(str string, spans []Span) ([]Span, bool) {
+	locs := m.rex.FindAllStringIndex(str, -1)
+	for _, loc := range locs {
+		if loc[0] < loc[1] {
+			spans = append(spans, Span{loc[0], loc[1]})
+		}
 	}
-	if len(node.Subnodes) > 0 {
-		str += "["
-		for i, child := range node.Subnodes {
-			if i > 0 {
-				str += ","
+	return spans, len(locs) > 0
+}
+
+// An ipMatcher matches if the input contains an IPv4 or IPv6 address in
+// one of its ranges. IPv4-mapped IPv6 addresses like '::ffff:10.0.0.1'
+// also match as IPv4 addresses.
+type ipMatcher struct {
+	args   []string
+	ranges []ipRange
+}
+
+// An ipRange is a range of IP addresses of the same family.
+type ipRange struct {
+	from, to netip.Addr
+}
+
+// newIPMatcher returns an ipMatcher for arguments like '10.0.0.0/8',
+// '192.168.0.1-192.168.0.99' or '::1'.
+func newIPMatcher(args []string) (Matcher, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing arguments")
+	}
+	m := &ipMatcher{args: args}
+	for _, arg := range args {
+		var r ipRange
+		if fromStr, toStr, ok := strings.Cut(arg, "-"); ok {
+			from, err1 := netip.ParseAddr(fromStr)
+			to, err2 := netip.ParseAddr(toStr)
+			if err1 != nil || err2 != nil || from.Zone() != "" || to.Zone() != "" || from.Is4() != to.Is4() || to.Less(from) {
+				return nil, fmt.Errorf("invalid range %q", arg)
 			}
-			str += explainNode(level+1, child)
+			r = ipRange{from, to}
+		} else if strings.Contains(arg, "/") {
+			prefix, err := netip.ParsePrefix(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q", arg)
+			}
+			prefix = prefix.Masked()
+			// the last address has all bits after the prefix set
+			last := prefix.Addr().AsSlice()
+			for i := prefix.Bits(); i < len(last)*8; i++ {
+				last[i/8] |= 0x80 >> (i % 8)
+			}
+			to, _ := netip.AddrFromSlice(last)
+			r = ipRange{prefix.Addr(), to}
+		} else {
+			addr, err := netip.ParseAddr(arg)
+			if err != nil || addr.Zone() != "" {
+				return nil, fmt.Errorf("invalid address %q", arg)
+			}
+			r = ipRange{addr, addr}
 		}
-		str += "]"
+		m.ranges = append(m.ranges, r)
 	}
-	return str
+	return m, nil
+}
+
+func (m *ipMatcher) Match(str string) bool {
+	for range m.addrs(str) {
+		return true
+	}
+	return false
 }
 
-const maxLevels = 20
+func (m *ipMatcher) String() string {
+	return internal.FormatCall("ip", m.args)
+}
 
-func buildMatcher(level int, node internal.Node) (Matcher, error) {
-	if level > maxLevels {
-		return nil, fmt.Errorf("too deep nesting level %d", level)
+func (m *ipMatcher) find(str string, spans []Span) ([]Span, bool) {
+	found := false
+	for span := range m.addrs(str) {
+		spans = append(spans, span)
+		found = true
 	}
-	var submatchers []Matcher
-	for _, subnode := range node.Subnodes {
-		submatcher, err := buildMatcher(level+1, subnode)
-		if err != nil {
-			return nil, err
+	return spans, found
+}
+
+// addrs yields the spans of the addresses in str that are in one of the
+// ranges of m, first the IPv4 addresses, then the IPv6 addresses.
+func (m *ipMatcher) addrs(str string) iter.Seq[Span] {
+	return func(yield func(Span) bool) {
+		for _, b := range []*builtin{ipv4Builtin, ipv6Builtin} {
+			bm := &builtinMatcher{b}
+			offset := 0
+			for {
+				span, ok := bm.next(str, offset)
+				if !ok {
+					break
+				}
+				offset = span.End
+				// the builtin accepted the address, so it is valid
+				addr, _ := netip.ParseAddr(str[span.Start:span.End])
+				if (m.contains(addr) || m.contains(addr.Unmap())) && !yield(span) {
+					return
+				}
+			}
 		}
-		submatchers = append(submatchers, submatcher)
 	}
-	switch node.Typ {
-	case internal.StringNode:
-		return &stringMatcher{node.Text}, nil
-	case internal.RegexNode:
-		rex, err := regexp.Compile(node.Text)
-		if err != nil {
-			return nil, err
+}
+
+// contains reports whether addr is in one of the ranges of m.
+func (m *ipMatcher) contains(addr netip.Addr) bool {
+	for _, r := range m.ranges {
+		if addr.Is4() == r.from.Is4() && addr.Compare(r.from) >= 0 && addr.Compare(r.to) <= 0 {
+			return true
 		}
-		return &regexMatcher{rex}, nil
-	case internal.NotNode:
-		return &notMatcher{submatchers}, nil
-	case internal.AndNode:
-		return &andMatcher{submatchers}, nil
-	case internal.OrNode:
-		return &orMatcher{submatchers}, nil
-	default:
-		panic("bad node type")
 	}
+	return false
 }
 
-// A stringMatcher matches if the input contains a given string.
-type stringMatcher struct {
-	str string
+// A countMatcher matches if its literal matcher matches at least min and
+// at most max times, not overlapping. A negative max means no maximum.
+type countMatcher struct {
+	m        Matcher
+	min, max int
 }
 
-func (m *stringMatcher) Match(str string) bool {
-	return strings.Contains(str, m.str)
+func (m *countMatcher) Match(str string) bool {
+	// counting can stop as soon as the maximum is exceeded, or
+	// the minimum is reached if there is no maximum
+	limit := m.min
+	if m.max >= 0 {
+		limit = m.max + 1
+	}
+	n := occurrences(m.m, str, limit)
+	return n >= m.min && (m.max < 0 || n <= m.max)
 }
 
-// A regexMatcher matches if the input matches a given regular expression.
-type regexMatcher struct {
-	rex *regexp.Regexp
+func (m *countMatcher) String() string {
+	return fmt.Sprint(m.m) + internal.FormatCount(m.min, m.max)
 }
 
-func (m *regexMatcher) Match(str string) bool {
-	return m.rex.MatchString(str)
+func (m *countMatcher) find(str string, spans []Span) ([]Span, bool) {
+	if !m.Match(str) {
+		return spans, false
+	}
+	spans, _ = find(m.m, str, spans)
+	return spans, true
+}
+
+// occurrences returns the number of non-overlapping matches of m in str,
+// but at most limit.
+func occurrences(m Matcher, str string, limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	switch m := m.(type) {
+	case *stringMatcher:
+		if m.str == "" {
+			return min(strings.Count(str, ""), limit)
+		}
+		// like strings.Count, but stop at limit
+		n := 0
+		for offset := 0; n < limit; n++ {
+			i := strings.Index(str[offset:], m.str)
+			if i < 0 {
+				break
+			}
+			offset += i + len(m.str)
+		}
+		return n
+	case *regexMatcher:
+		return len(m.rex.FindAllStringIndex(str, limit))
+	}
+	spans, ok := find(m, str, nil)
+	if ok && len(spans) == 0 {
+		// matched, but empty
+		return 1
+	}
+	return min(len(spans), limit)
+}
+
+// A funcMatcher matches if the matcher that a Func returned matches.
+type funcMatcher struct {
+	name string
+	args []string
+	m    Matcher
+}
+
+func (m *funcMatcher) Match(str string) bool {
+	return m.m.Match(str)
+}
+
+func (m *funcMatcher) String() string {
+	return internal.FormatCall(m.name, m.args)
+}
+
+func (m *funcMatcher) find(str string, spans []Span) ([]Span, bool) {
+	return find(m.m, str, spans)
 }
 
 // A notMatcher matches if no child matcher matches.
@@ -146,6 +1724,19 @@ func (m *notMatcher) Match(str string) bool {
 	return true
 }
 
+func (m *notMatcher) String() string {
+	if len(m.matchers) == 1 {
+		return "NOT " + operand(m.matchers[0], internal.NotPrec)
+	}
+	return "NOT (" + join(m.matchers, " OR ", internal.OrPrec) + ")"
+}
+
+func (m *notMatcher) precedence() int { return internal.NotPrec }
+
+func (m *notMatcher) find(str string, spans []Span) ([]Span, bool) {
+	return spans, m.Match(str)
+}
+
 // An andMatcher matches if every child matcher matches.
 type andMatcher struct {
 	matchers []Matcher
@@ -160,6 +1751,24 @@ func (m *andMatcher) Match(str string) bool {
 	return true
 }
 
+func (m *andMatcher) String() string {
+	return join(m.matchers, " AND ", internal.AndPrec)
+}
+
+func (m *andMatcher) precedence() int { return internal.AndPrec }
+
+func (m *andMatcher) find(str string, spans []Span) ([]Span, bool) {
+	n := len(spans)
+	for _, child := range m.matchers {
+		var ok bool
+		spans, ok = find(child, str, spans)
+		if !ok {
+			return spans[:n], false
+		}
+	}
+	return spans, true
+}
+
 // An orMatcher matches if at least one child matcher matches.
 type orMatcher struct {
 	matchers []Matcher
@@ -173,3 +1782,382 @@ func (m *orMatcher) Match(str string) bool {
 	}
 	return false
 }
+
+func (m *orMatcher) String() string {
+	return join(m.matchers, " OR ", internal.OrPrec)
+}
+
+func (m *orMatcher) precedence() int { return internal.OrPrec }
+
+func (m *orMatcher) find(str string, spans []Span) ([]Span, bool) {
+	// unlike Match, do not stop at the first match: every matching
+	// alternative contributes its spans
+	found := false
+	for _, child := range m.matchers {
+		var ok bool
+		spans, ok = find(child, str, spans)
+		found = found || ok
+	}
+	return spans, found
+}
+
+// A xorMatcher matches if an odd number of child matchers match.
+type xorMatcher struct {
+	matchers []Matcher
+}
+
+func (m *xorMatcher) Match(str string) bool {
+	// every child decides the result, so there is no short cut
+	result := false
+	for _, child := range m.matchers {
+		if child.Match(str) {
+			result = !result
+		}
+	}
+	return result
+}
+
+func (m *xorMatcher) String() string {
+	return join(m.matchers, " XOR ", internal.XorPrec)
+}
+
+func (m *xorMatcher) precedence() int { return internal.XorPrec }
+
+func (m *xorMatcher) find(str string, spans []Span) ([]Span, bool) {
+	n := len(spans)
+	result := false
+	for _, child := range m.matchers {
+		var ok bool
+		spans, ok = find(child, str, spans)
+		if ok {
+			result = !result
+		}
+	}
+	if !result {
+		return spans[:n], false
+	}
+	return spans, true
+}
+
+// An impliesMatcher matches if x does not match or y matches.
+type impliesMatcher struct {
+	x, y Matcher
+}
+
+func (m *impliesMatcher) Match(str string) bool {
+	return !m.x.Match(str) || m.y.Match(str)
+}
+
+func (m *impliesMatcher) String() string {
+	// IMPLIES is right-associative
+	return operand(m.x, internal.ImpliesPrec+1) + " IMPLIES " + operand(m.y, internal.ImpliesPrec)
+}
+
+func (m *impliesMatcher) precedence() int { return internal.ImpliesPrec }
+
+func (m *impliesMatcher) find(str string, spans []Span) ([]Span, bool) {
+	n := len(spans)
+	spans, ok := find(m.x, str, spans)
+	if !ok {
+		// like 'NOT x', without spans
+		return spans[:n], true
+	}
+	spans, ok = find(m.y, str, spans)
+	if !ok {
+		return spans[:n], false
+	}
+	return spans, true
+}
+
+// A nearMatcher matches if the spans of x and y are at most distance
+// whitespace-separated words apart. If ordered is set, x must end before
+// y starts.
+type nearMatcher struct {
+	x, y     Matcher
+	distance int
+	ordered  bool
+}
+
+func (m *nearMatcher) Match(str string) bool {
+	xs, ys, ok := m.operands(str)
+	if !ok {
+		return false
+	}
+	// one qualifying pair is enough
+	if m.ordered {
+		return len(beforeSpans(xs, ys, m.distance, 1)) > 0
+	}
+	return len(nearSpans(xs, ys, m.distance, 1)) > 0
+}
+
+func (m *nearMatcher) String() string {
+	op := fmt.Sprintf(" NEAR/%d ", m.distance)
+	if m.ordered {
+		op = fmt.Sprintf(" BEFORE/%d ", m.distance)
+	}
+	// NEAR and BEFORE are left-associative
+	return operand(m.x, internal.NearPrec) + op + operand(m.y, internal.NearPrec+1)
+}
+
+func (m *nearMatcher) precedence() int { return internal.NearPrec }
+
+func (m *nearMatcher) find(str string, spans []Span) ([]Span, bool) {
+	xs, ys, ok := m.operands(str)
+	if !ok {
+		return spans, false
+	}
+	// report every span that is part of a qualifying pair, once
+	var xfound, yfound []Span
+	if m.ordered {
+		xfound = beforeSpans(xs, ys, m.distance, -1)
+		yfound = afterSpans(ys, xs, m.distance, -1)
+	} else {
+		xfound = nearSpans(xs, ys, m.distance, -1)
+		yfound = nearSpans(ys, xs, m.distance, -1)
+	}
+	if len(xfound) == 0 {
+		return spans, false
+	}
+	return append(append(spans, xfound...), yfound...), true
+}
+
+// operands returns the word spans of the matches of x and y, sorted by
+// their start, and reports whether both matched.
+func (m *nearMatcher) operands(str string) ([]wordSpan, []wordSpan, bool) {
+	xspans, ok := find(m.x, str, nil)
+	if !ok || len(xspans) == 0 {
+		return nil, nil, false
+	}
+	yspans, ok := find(m.y, str, nil)
+	if !ok || len(yspans) == 0 {
+		return nil, nil, false
+	}
+	words := wordStarts(str)
+	return wordSpans(words, xspans), wordSpans(words, yspans), true
+}
+
+// A thenMatcher matches if the child matchers match in order, each
+// match ending before the match of the next child starts.
+type thenMatcher struct {
+	matchers []Matcher
+}
+
+func (m *thenMatcher) Match(str string) bool {
+	_, ok := m.find(str, nil)
+	return ok
+}
+
+func (m *thenMatcher) String() string {
+	// THEN has the same precedence as the left-associative NEAR
+	strs := make([]string, len(m.matchers))
+	for i, child := range m.matchers {
+		strs[i] = operand(child, internal.NearPrec+min(i, 1))
+	}
+	return strings.Join(strs, " THEN ")
+}
+
+func (m *thenMatcher) precedence() int { return internal.NearPrec }
+
+func (m *thenMatcher) find(str string, spans []Span) ([]Span, bool) {
+	// choosing the earliest ending match of each child leaves the most
+	// room for the following children
+	var chain []Span
+	end := 0
+	for _, child := range m.matchers {
+		childSpans, ok := find(child, str, nil)
+		if !ok {
+			return spans, false
+		}
+		next := Span{-1, -1}
+		for _, span := range childSpans {
+			if span.Start >= end && (next.End < 0 || span.End < next.End) {
+				next = span
+			}
+		}
+		if next.End < 0 {
+			return spans, false
+		}
+		chain = append(chain, next)
+		end = next.End
+	}
+	return append(spans, chain...), true
+}
+
+// A thresholdMatcher matches if the number of matching child matchers is
+// at least (ATLEAST), exactly (EXACTLY) or at most (ATMOST) count.
+type thresholdMatcher struct {
+	op       string
+	count    int
+	matchers []Matcher
+}
+
+// bounds returns the minimum and maximum number of matching children.
+func (m *thresholdMatcher) bounds() (int, int) {
+	switch m.op {
+	case "ATLEAST":
+		return m.count, len(m.matchers)
+	case "ATMOST":
+		return 0, m.count
+	}
+	return m.count, m.count
+}
+
+func (m *thresholdMatcher) Match(str string) bool {
+	lo, hi := m.bounds()
+	matched, remaining := 0, len(m.matchers)
+	for _, child := range m.matchers {
+		// stop as soon as the remaining children cannot change the result
+		if matched > hi || matched+remaining < lo {
+			return false
+		}
+		if matched >= lo && matched+remaining <= hi {
+			return true
+		}
+		if child.Match(str) {
+			matched++
+		}
+		remaining--
+	}
+	return matched >= lo && matched <= hi
+}
+
+func (m *thresholdMatcher) String() string {
+	// operands are separated by commas, so they never need parentheses
+	return fmt.Sprintf("%s %d (%s)", m.op, m.count, join(m.matchers, ", ", internal.ImpliesPrec))
+}
+
+func (m *thresholdMatcher) find(str string, spans []Span) ([]Span, bool) {
+	// like orMatcher, every matching child contributes its spans
+	n := len(spans)
+	lo, hi := m.bounds()
+	matched := 0
+	for _, child := range m.matchers {
+		var ok bool
+		spans, ok = find(child, str, spans)
+		if ok {
+			matched++
+		}
+	}
+	if matched < lo || matched > hi {
+		return spans[:n], false
+	}
+	return spans, true
+}
+
+// wordStarts returns the offsets of the whitespace-separated words of str.
+func wordStarts(str string) []int {
+	var starts []int
+	space := true
+	for i, r := range str {
+		if !unicode.IsSpace(r) && space {
+			starts = append(starts, i)
+		}
+		space = unicode.IsSpace(r)
+	}
+	return starts
+}
+
+// A wordSpan is a span and the indexes of its first and last word.
+type wordSpan struct {
+	Span
+	first, last int
+}
+
+// wordSpans returns the word spans of spans, sorted by their start.
+func wordSpans(words []int, spans []Span) []wordSpan {
+	wspans := make([]wordSpan, len(spans))
+	for i, span := range spans {
+		wspans[i] = wordSpan{span, wordIndex(words, span.Start), wordIndex(words, span.End-1)}
+	}
+	slices.SortFunc(wspans, func(a, b wordSpan) int { return a.Start - b.Start })
+	return wspans
+}
+
+// nearSpans returns the spans of xs that overlap a span of ys or are at
+// most distance words apart from it, in any order. It stops after limit
+// spans, unless limit is negative.
+// Going through xs by their last word, the ys that start at most distance
+// words after x only grow, and the one with the greatest last word is the
+// closest one before x.
+func nearSpans(xs, ys []wordSpan, distance, limit int) []Span {
+	xs = slices.Clone(xs)
+	slices.SortStableFunc(xs, func(a, b wordSpan) int { return a.last - b.last })
+	var found []Span
+	j, last := 0, 0
+	for _, x := range xs {
+		for ; j < len(ys) && ys[j].first <= x.last+distance; j++ {
+			if j == 0 || ys[j].last > last {
+				last = ys[j].last
+			}
+		}
+		if j > 0 && last >= x.first-distance {
+			found = append(found, x.Span)
+			if len(found) == limit {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// beforeSpans returns the spans of xs that end before a span of ys starts,
+// at most distance words before it. It stops after limit spans, unless
+// limit is negative.
+// Going through xs by their end, the first y that starts after x, which
+// has the smallest first word, moves only forward.
+func beforeSpans(xs, ys []wordSpan, distance, limit int) []Span {
+	xs = slices.Clone(xs)
+	slices.SortStableFunc(xs, func(a, b wordSpan) int { return a.End - b.End })
+	var found []Span
+	j := 0
+	for _, x := range xs {
+		for j < len(ys) && ys[j].Start < x.End {
+			j++
+		}
+		if j == len(ys) {
+			break
+		}
+		if ys[j].first-x.last <= distance {
+			found = append(found, x.Span)
+			if len(found) == limit {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// afterSpans returns the spans of ys that start after a span of xs ends,
+// at most distance words after it. It stops after limit spans, unless
+// limit is negative.
+// Going through ys by their start, the xs that end before y only grow,
+// and the one with the greatest last word is the closest.
+func afterSpans(ys, xs []wordSpan, distance, limit int) []Span {
+	xs = slices.Clone(xs)
+	slices.SortStableFunc(xs, func(a, b wordSpan) int { return a.End - b.End })
+	var found []Span
+	j, last := 0, 0
+	for _, y := range ys {
+		for ; j < len(xs) && xs[j].End <= y.Start; j++ {
+			if j == 0 || xs[j].last > last {
+				last = xs[j].last
+			}
+		}
+		if j > 0 && y.first-last <= distance {
+			found = append(found, y.Span)
+			if len(found) == limit {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// wordIndex returns the index of the word that contains offset.
+func wordIndex(words []int, offset int) int {
+	i, found := slices.BinarySearch(words, offset)
+	if found {
+		return i
+	}
+	return i - 1
+}
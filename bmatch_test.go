@@ -6,21 +6,27 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cvilsmeier/bmatch/ast"
 	"github.com/cvilsmeier/bmatch/internal"
 )
 
+// An input is a text and whether an expression matches it.
+type input struct {
+	text   string
+	result bool
+}
+
+// A testcase is an expression, its plan or, after "err: ", its syntax
+// error, and the inputs it must or must not match.
+type testcase struct {
+	name      string
+	expr      string
+	planOrErr string
+	inputs    []input
+}
+
 func TestBmatch(t *testing.T) {
-	type input struct {
-		text   string
-		result bool
-	}
-	type testcase struct {
-		name      string
-		expr      string
-		planOrErr string
-		inputs    []input
-	}
-	for _, tt := range []testcase{
+	testBmatch(t, Options{}, []testcase{
 		{
 			"emptyString",
 			"",
@@ -194,38 +200,191 @@ func TestBmatch(t *testing.T) {
 		{
 			"errUnclosedGroup",
 			"DEBUG OR (TRACE AND NOT SQL",
-			"err: syntax error",
+			"err: syntax error at column 28: unexpected end of expression, expected \"AND\", \"OR\", \"XOR\", \"IMPLIES\", \"NEAR/n\", \"BEFORE/n\", \"THEN\" or \")\"",
 			[]input{},
 		},
+		{
+			"loneModifiers",
+			"^ OR ~ OR word: OR glob: OR $",
+			"OR['^','~','word:','glob:','$']",
+			[]input{
+				{"", false},
+				{"a^b", true},
+				{"~", true},
+				{"word:", true},
+				{"glob", false},
+				{"$", true},
+			},
+		},
+		{
+			"invalidUTF8",
+			`"a\xffb"`,
+			"'a\xffb'",
+			[]input{
+				{"a\xffb", true},
+				{"a\uFFFDb", false},
+				{"ab", false},
+			},
+		},
 		{
 			"errUnclosedRegex",
 			"DEBUG OR /aa",
-			"err: unclosed regex in \"aa\"",
+			"err: syntax error at column 10: unclosed regex \"/aa\"",
 			[]input{},
 		},
 		{
 			"errUnbalancedAnd",
 			"DEBUG AND",
-			"err: syntax error",
+			"err: syntax error at column 10: unexpected end of expression, expected literal, \"(\", \"NOT\", \"ATLEAST\", \"EXACTLY\" or \"ATMOST\"",
 			[]input{},
 		},
-	} {
+		// literal modifiers
+		{"modifiers1", "/timeout/i AND ORDER-ID", "AND[/timeout/i,'ORDER-ID']", []input{{"TIMEOUT ORDER-ID", true}, {"Timeout order-id", false}}},
+		{"modifiers2", "~timeout AND ORDER-ID", "AND['timeout'i,'ORDER-ID']", []input{{"TIMEOUT ORDER-ID", true}, {"Timeout order-id", false}}},
+		{"modifiers3", "/^a.b$/s", "/^a.b$/s", []input{{"a\nb", true}, {"a\nb\n", false}}},
+		{"modifiers4", "/^b$/m", "/^b$/m", []input{{"a\nb\nc", true}, {"abc", false}}},
+		{"modifiers5", "/a+/U AND /x/", "AND[/a+/U,/x/]", []input{{"aax", true}, {"aa", false}}},
+		{"modifiers6", "/^A.B$/is", "/^A.B$/is", []input{{"a\nb", true}, {"a\nc", false}}},
+		{"modifiers7", "~\\~x", "'~x'i", []input{{"~X", true}, {"X", false}}},
+		// quoted strings
+		{"quoted1", `"little cat" AND big\ dog`, "AND['little cat','big dog']", []input{{"little cat, big dog", true}, {"little  cat, big dog", false}}},
+		{"quoted2", `"a\tb"`, "'a\tb'", []input{{"a\tb", true}, {"a b", false}}},
+		{"quoted3", `"a\nb"`, "'a\nb'", []input{{"a\nb", true}, {"ab", false}}},
+		{"quoted4", `"say \"hi\""`, `'say "hi"'`, []input{{`they say "hi"`, true}, {"say hi", false}}},
+		{"quoted5", `"café" OR "\x00"`, "OR['café','\x00']", []input{{"café", true}, {"a\x00b", true}, {"cafe", false}}},
+		{"quoted6", `"NOT" AND NOT "AND"`, "AND['NOT',NOT['AND']]", []input{{"NOT", true}, {"NOT AND", false}}},
+		{"quoted7", `~"Little Cat"`, "'Little Cat'i", []input{{"LITTLE CAT", true}, {"little-cat", false}}},
+		// whole words
+		{"word1", "word:error", "'error'w", []input{{"error", true}, {"an error!", true}, {"errorless", false}, {"terror", false}, {"error_2", false}, {"terror error", true}}},
+		{"word2", "~word:error", "'error'iw", []input{{"ERROR", true}, {"Errors", false}}},
+		{"word3", "word:über", "'über'w", []input{{"das über", true}, {"darüber", false}, {"übera", false}, {"über1", false}}},
+		{"word4", `word:"log in"`, "'log in'w", []input{{"please log in.", true}, {"blog in", false}, {"log inside", false}}},
+		{"word5", "word:-x", "'-x'w", []input{{"a -x b", true}, {"a--x", true}, {"a -xy", false}}},
+		{"word6", `word\:x`, "'word:x'", []input{{"word:xy", true}, {"x", false}}},
+		{"word7", `"word:x"`, "'word:x'", []input{{"word:xy", true}, {"x", false}}},
+		{"word8", "word:a AND NOT b", "AND['a'w,NOT['b']]", []input{{"a c", true}, {"ab", false}, {"a b", false}}},
+		// anchors
+		{"anchor1", "^WARN", "^'WARN'", []input{{"WARN: x", true}, {"WARN", true}, {"a WARN", false}, {"warn", false}, {"", false}}},
+		{"anchor2", "done$", "'done'$", []input{{"all done", true}, {"done.", false}, {"", false}}},
+		{"anchor3", "^exact$", "^'exact'$", []input{{"exact", true}, {"exact ", false}, {" exact", false}}},
+		{"anchor4", "^$", "^''$", []input{{"", true}, {" ", false}}},
+		{"anchor5", "]$ AND NOT ^[", "AND[']'$,NOT[^'[']]", []input{{"a]", true}, {"[a]", false}, {"a] ", false}}},
+		{"anchor6", "~^warn", "^'warn'i", []input{{"Warn: x", true}, {"a warn", false}}},
+		{"anchor7", "~done$", "'done'$i", []input{{"ALL DONE", true}, {"DONE!", false}}},
+		{"anchor8", "~^K$", "^'K'$i", []input{{"k", true}, {"K", true}, {"kk", false}, {"", false}}},
+		{"anchor9", "~^äb$", "^'äb'$i", []input{{"ÄB", true}, {"ÄBC", false}}},
+		{"anchor10", "~äb$", "'äb'$i", []input{{"xÄB", true}, {"b", false}, {"", false}}},
+		{"anchor11", "word:^err", "^'err'w", []input{{"err: x", true}, {"errors", false}}},
+		{"anchor12", "word:err$", "'err'$w", []input{{"an err", true}, {"terr", false}}},
+		{"anchor13", `^"a b"$`, "^'a b'$", []input{{"a b", true}, {"a b c", false}}},
+		{"anchor14", "a$b", "'a$b'", []input{{"xa$by", true}, {"a", false}}},
+		{"anchor15", `\^a OR b\$`, "OR['^a','b$']", []input{{"x^a", true}, {"b$x", true}, {"a", false}}},
+		// globs
+		{"glob1", "glob:user-*-prod", "'user-*-prod'g", []input{{"user-42-prod", true}, {"x user--prod y", true}, {"user-42-dev", false}, {"user-prod", false}}},
+		{"glob2", "glob:conn?ct", "'conn?ct'g", []input{{"connect", true}, {"connäct", true}, {"connct", false}, {"conn--ct", false}}},
+		{"glob3", "glob:a*b*c", "'a*b*c'g", []input{{"abc", true}, {"xaxbxcx", true}, {"acb", false}, {"cba", false}}},
+		{"glob4", "glob:*a*", "'*a*'g", []input{{"a", true}, {"bab", true}, {"b", false}}},
+		{"glob5", "glob:*", "'*'g", []input{{"", true}, {"a", true}}},
+		{"glob6", "~glob:user-*-PROD", "'user-*-PROD'ig", []input{{"USER-1-prod", true}, {"user-1-dev", false}}},
+		{"glob7", "glob:^user-*", "^'user-*'g", []input{{"user-1", true}, {"a user-1", false}}},
+		{"glob8", "glob:*-prod$", "'*-prod'$g", []input{{"a-prod", true}, {"a-prod-b", false}}},
+		{"glob9", "glob:^a?c$", "^'a?c'$g", []input{{"abc", true}, {"abcd", false}, {"xabc", false}, {"ac", false}}},
+		{"glob10", "glob:^a*c$", "^'a*c'$g", []input{{"ac", true}, {"abcbc", true}, {"abcd", false}, {"c", false}}},
+		{"glob11", "glob:a?c$", "'a?c'$g", []input{{"xabc", true}, {"bc", false}, {"", false}}},
+		{"glob12", "~glob:^ä*Ö$", "^'ä*Ö'$ig", []input{{"Äxö", true}, {"Ä", false}}},
+		{"glob13", "glob:a\\*b", "'a\\*b'g", []input{{"a*b", true}, {"axb", false}}},
+		{"glob14", `glob:"a \\? b"`, "'a \\? b'g", []input{{"a ? b", true}, {"a x b", false}}},
+		{"glob15", "a*b", "'a*b'", []input{{"a*b", true}, {"axb", false}}},
+		// NEAR and BEFORE
+		{"near1", "timeout NEAR/5 db", "NEAR/5['timeout','db']", []input{{"timeout a b c d db", true}, {"db a b c d timeout", true}, {"timeout a b c d e db", false}, {"timeout", false}}},
+		{"near2", "timeout BEFORE/5 db", "BEFORE/5['timeout','db']", []input{{"timeout a b c d db", true}, {"db a b c d timeout", false}}},
+		{"near3", "a NEAR/0 b", "NEAR/0['a','b']", []input{{"ab", true}, {"a-b", true}, {"a b", false}}},
+		{"near4", "a NEAR/1 b", "NEAR/1['a','b']", []input{{"a  \t b", true}, {"a x b", false}}},
+		{"near5", "/err(or)?/ NEAR/2 ~DB", "NEAR/2[/err(or)?/,'DB'i]", []input{{"db: error", true}, {"err in the db", false}}},
+		{"near6", "x NEAR/1 (a OR b)", "NEAR/1['x',OR['a','b']]", []input{{"b x", true}, {"a c x", false}}},
+		{"near7", "x AND y NEAR/1 z", "AND['x',NEAR/1['y','z']]", []input{{"y z x", true}, {"y x z", false}}},
+		{"near8", "a NEAR/1 b AND b NEAR/1 c", "AND[NEAR/1['a','b'],NEAR/1['b','c']]", []input{{"a b c", true}, {"c a b", false}, {"a x b c", false}}},
+		{"near9", "(a OR b) NEAR/1 (c OR /d+/)", "NEAR/1[OR['a','b'],OR['c',/d+/]]", []input{{"dd b", true}, {"a x c", false}}},
+		{"near10", "connect BEFORE/3 failed", "BEFORE/3['connect','failed']", []input{{"connect: x failed", true}, {"failed to connect", false}, {"failed connect failed", true}}},
+		{"errNearNot", "a BEFORE/9 NOT b", "err: syntax error at column 12: invalid operand NOT b of BEFORE/9: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearAtmost", "a NEAR/3 ATMOST 1 (b, c)", "err: syntax error at column 10: invalid operand ATMOST 1 (b, c) of NEAR/3: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearEmptyRegex", "/x*/ NEAR/1 a", "err: syntax error at column 1: invalid operand /x*/ of NEAR/1: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearEmptyString", "a NEAR/1 (b OR \"\")", "err: syntax error at column 10: invalid operand b OR \"\" of NEAR/1: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearAnd", "(a AND b) NEAR/0 c", "err: syntax error at column 1: invalid operand a AND b of NEAR/0: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearNear", "a NEAR/1 b NEAR/1 c", "err: syntax error at column 1: invalid operand a NEAR/1 b of NEAR/1: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errNearThen", "a BEFORE/1 (b THEN c)", "err: syntax error at column 12: invalid operand b THEN c of BEFORE/1: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		// THEN
+		{"then1", "connect THEN failed", "THEN['connect','failed']", []input{{"connect to db failed", true}, {"connectfailed", true}, {"failed to connect", false}, {"failed connect", false}}},
+		{"then2", "a THEN b THEN c", "THEN['a','b','c']", []input{{"a b c", true}, {"abc", true}, {"a c b", false}, {"b a b c", true}, {"c a b", false}}},
+		{"then3", "/a+/ THEN a", "THEN[/a+/,'a']", []input{{"aa", false}, {"aa a", true}}},
+		{"then4", "aba THEN ab", "THEN['aba','ab']", []input{{"abab", false}, {"ababab", true}}},
+		{"then5", "(x OR y) THEN z", "THEN[OR['x','y'],'z']", []input{{"y z", true}, {"z x", false}}},
+		{"then6", "a AND b THEN c", "AND['a',THEN['b','c']]", []input{{"c a b c", true}, {"c b a", false}}},
+		{"errThenNot", "NOT a THEN b", "err: syntax error at column 1: invalid operand NOT a of THEN: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errThenAnd", "(connect AND db) THEN failed", "err: syntax error at column 1: invalid operand connect AND db of THEN: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errThenThreshold", "a THEN ATLEAST 1 (b, c)", "err: syntax error at column 8: invalid operand ATLEAST 1 (b, c) of THEN: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		{"errThenEmptyString", "a THEN \"\" THEN b", "err: syntax error at column 8: invalid operand \"\" of THEN: it must be a literal or an OR of literals that match non-empty text", []input{}},
+		// ATLEAST, EXACTLY and ATMOST
+		{"threshold1", "ATLEAST 2 (timeout, retry, 503, refused)", "ATLEAST 2['timeout','retry','503','refused']", []input{{"timeout", false}, {"503 timeout", true}, {"retry refused 503", true}, {"ok", false}}},
+		{"threshold2", "EXACTLY 1 (a, b, c)", "EXACTLY 1['a','b','c']", []input{{"a", true}, {"c", true}, {"ab", false}, {"x", false}}},
+		{"threshold3", "ATMOST 1 (a, b, c)", "ATMOST 1['a','b','c']", []input{{"", true}, {"b", true}, {"bc", false}, {"abc", false}}},
+		{"threshold4", "EXACTLY 0 (a, b)", "EXACTLY 0['a','b']", []input{{"x", true}, {"b", false}}},
+		{"threshold5", "ATLEAST 1 (a AND b, NOT c)", "ATLEAST 1[AND['a','b'],NOT['c']]", []input{{"abc", true}, {"c", false}, {"", true}}},
+		{"threshold6", "x AND ATLEAST 2 (/a+/, ~B)", "AND['x',ATLEAST 2[/a+/,'B'i]]", []input{{"x aab", true}, {"aab", false}, {"x a", false}}},
+		// occurrence counts
+		{"count1", ",{3,}", "','{3,}", []input{{"a,b,c,d", true}, {"a,b,c", false}, {",,,,,", true}}},
+		{"count2", "ERROR{1}", "'ERROR'{1}", []input{{"ERROR: x", true}, {"ERROR: ERROR", false}, {"error", false}}},
+		{"count3", "aa{2}", "'aa'{2}", []input{{"aaa", false}, {"aaaa", true}, {"aaaaaa", false}}},
+		{"count4", "/[0-9]+/{2,3}", "/[0-9]+/{2,3}", []input{{"1", false}, {"1 22", true}, {"1 2 3", true}, {"1 2 3 4", false}}},
+		{"count5", "~err{0}", "'err'i{0}", []input{{"ok", true}, {"ERR", false}}},
+		{"count6", "word:a{2}", "'a'w{2}", []input{{"a b a", true}, {"aa a", false}}},
+		{"count7", "glob:a?{2}", "'a?'g{2}", []input{{"ab ac", true}, {"abac", true}, {"ab", false}}},
+		{"count8", "^a{1} AND b\\${1}", "AND[^'a'{1},'b$'{1}]", []input{{"ab$", true}, {"b$ a", false}}},
+		{"count9", "NOT x{2,}", "NOT['x'{2,}]", []input{{"x", true}, {"xx", false}}},
+		// XOR and IMPLIES
+		{"xor1", "a XOR b", "XOR['a','b']", []input{{"a", true}, {"b", true}, {"ab", false}, {"x", false}}},
+		{"xor2", "a XOR b XOR c", "XOR['a','b','c']", []input{{"a", true}, {"ab", false}, {"abc", true}, {"x", false}}},
+		{"xor3", "a XOR b AND c", "XOR['a',AND['b','c']]", []input{{"ab", true}, {"abc", false}, {"bc", true}}},
+		{"xor4", "retry IMPLIES attempt=", "IMPLIES['retry','attempt=']", []input{{"ok", true}, {"retry attempt=2", true}, {"retry", false}, {"attempt=2", true}}},
+		{"xor5", "a IMPLIES b IMPLIES c", "IMPLIES['a',IMPLIES['b','c']]", []input{{"ab", false}, {"abc", true}, {"a", true}, {"b", true}}},
+		{"xor6", "a OR b IMPLIES c", "IMPLIES[OR['a','b'],'c']", []input{{"b", false}, {"bc", true}, {"x", true}}},
+	})
+}
+
+// testBmatch runs testcases with the given options.
+func testBmatch(t *testing.T, opts Options, testcases []testcase) {
+	for _, tt := range testcases {
 		t.Run(tt.name, func(t *testing.T) {
 			is := internal.Assert(t)
 			if strings.HasPrefix(tt.planOrErr, "err: ") {
-				_, err := Explain(tt.expr)
+				_, err := ExplainWithOptions(tt.expr, opts)
 				is.Eq(tt.planOrErr, fmt.Sprintf("err: %s", err))
-				_, err = Compile(tt.expr)
+				_, err = CompileWithOptions(tt.expr, opts)
 				is.Eq(tt.planOrErr, fmt.Sprintf("err: %s", err))
 			} else {
-				plan, err := Explain(tt.expr)
+				plan, err := ExplainWithOptions(tt.expr, opts)
 				is.NoErr(err)
 				is.Eq(tt.planOrErr, plan)
-				matcher, err := Compile(tt.expr)
+				matcher, err := CompileWithOptions(tt.expr, opts)
 				is.NoErr(err)
 				for _, input := range tt.inputs {
 					is.Eqf(input.result, matcher.Match(input.text), "for input text %q", input.text)
 				}
+				// round trip of matcher and syntax tree must be equivalent,
+				// the matcher renders the options, the syntax tree does not
+				node, err := ParseExprWithOptions(tt.expr, opts)
+				is.NoErr(err)
+				for _, rt := range []struct {
+					str  string
+					opts Options
+				}{{fmt.Sprint(matcher), Options{}}, {node.String(), opts}} {
+					rematcher, err := CompileWithOptions(rt.str, rt.opts)
+					is.NoErr(err)
+					is.Eqf(fmt.Sprint(matcher), fmt.Sprint(rematcher), "for round trip %q", rt.str)
+					for _, input := range tt.inputs {
+						is.Eqf(input.result, rematcher.Match(input.text), "for round trip %q and input text %q", rt.str, input.text)
+					}
+				}
 			}
 		})
 	}
@@ -383,3 +542,706 @@ func BenchmarkBmatchMatch(b *testing.B) {
 		}
 	}
 }
+
+func TestFindAll(t *testing.T) {
+	type testcase struct {
+		expr  string
+		input string
+		want  string
+	}
+	for _, tt := range []testcase{
+		{"", "foo", "[]"},
+		{"foo", "", "nil"},
+		{"foo", "foo bar foo", "[{0 3} {8 11}]"},
+		{"foo", "foofoo", "[{0 3} {3 6}]"},
+		{"/o+/", "foo boo", "[{1 3} {5 7}]"},
+		{"/x*/", "foo", "[]"},
+		{"NOT foo", "bar", "[]"},
+		{"NOT foo", "foo", "nil"},
+		{"foo AND NOT bar", "foo baz", "[{0 3}]"},
+		{"foo AND bar", "bar foo", "[{0 3} {4 7}]"},
+		{"foo AND bar", "foo", "nil"},
+		{"foo OR bar", "bar foo", "[{0 3} {4 7}]"},
+		{"foo OR bar", "baz", "nil"},
+		{"foo OR (bar AND baz)", "foo bar", "[{0 3}]"},
+		{"fo OR /o+b/", "foobar", "[{0 4}]"},
+	} {
+		is := internal.Assert(t)
+		m := MustCompile(tt.expr)
+		spans := FindAll(m, tt.input)
+		have := fmt.Sprint(spans)
+		if spans == nil {
+			have = "nil"
+		}
+		is.Eqf(tt.want, have, "FindAll(%q, %q)", tt.expr, tt.input)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	is := internal.Assert(t)
+	_, err := Compile("foo AND AND bar")
+	serr, ok := err.(*SyntaxError)
+	is.True(ok)
+	is.Eq(8, serr.Offset)
+	is.Eq(9, serr.Column)
+	is.Eq("AND", serr.Token)
+	is.Eq(`unexpected "AND"`, serr.Msg)
+	is.Eq("literal ( NOT ATLEAST EXACTLY ATMOST", strings.Join(serr.Expected, " "))
+	is.Eq(`syntax error at column 9: unexpected "AND", expected literal, "(", "NOT", "ATLEAST", "EXACTLY" or "ATMOST"`, serr.Error())
+	is.Eq("foo AND AND bar\n        ^", serr.Caret())
+	// columns count runes, not bytes
+	_, err = Compile("äöü OR )")
+	serr = err.(*SyntaxError)
+	is.Eq(10, serr.Offset)
+	is.Eq(8, serr.Column)
+	is.Eq(")", serr.Token)
+	is.Eq("äöü OR )\n       ^", serr.Caret())
+	// errors at the end of the expression
+	_, err = Compile("(foo")
+	serr = err.(*SyntaxError)
+	is.Eq(4, serr.Offset)
+	is.Eq(5, serr.Column)
+	is.Eq("", serr.Token)
+	is.Eq("(foo\n    ^", serr.Caret())
+	// lexer errors
+	_, err = Compile("foo OR /ba")
+	serr = err.(*SyntaxError)
+	is.Eq(8, serr.Column)
+	is.Eq("/ba", serr.Token)
+	is.Eq(`syntax error at column 8: unclosed regex "/ba"`, serr.Error())
+	// regex errors
+	_, err = Compile("foo OR /a(b/")
+	serr = err.(*SyntaxError)
+	is.Eq(8, serr.Column)
+	is.Eq("/a(b/", serr.Token)
+	is.Eq("syntax error at column 8: error parsing regexp: missing closing ): `a(b`", serr.Error())
+}
+
+func TestParseExpr(t *testing.T) {
+	is := internal.Assert(t)
+	node, err := ParseExpr("foo AND NOT (/bar/ OR baz)")
+	is.NoErr(err)
+	and, ok := node.(*ast.AndExpr)
+	is.True(ok)
+	is.Eq(0, and.Pos())
+	is.Eq(26, and.End())
+	is.Eq(2, len(and.Operands))
+	is.Eq("foo", and.Operands[0].(*ast.StringLit).Value)
+	not := and.Operands[1].(*ast.NotExpr)
+	is.Eq(8, not.Pos())
+	or := not.X.(*ast.OrExpr)
+	is.Eq(12, or.Pos())
+	is.Eq(26, or.End())
+	is.Eq("bar", or.Operands[0].(*ast.RegexLit).Pattern)
+	is.Eq("baz", or.Operands[1].(*ast.StringLit).Value)
+	_, err = ParseExpr("foo AND")
+	is.Eq("syntax error at column 8: unexpected end of expression, expected literal, \"(\", \"NOT\", \"ATLEAST\", \"EXACTLY\" or \"ATMOST\"", err.Error())
+	node, err = ParseExprWithOptions("foo*", Options{Glob: true})
+	is.NoErr(err)
+	is.Eq("foo*", node.(*ast.GlobLit).Pattern)
+}
+
+func TestString(t *testing.T) {
+	type testcase struct {
+		expr string
+		want string
+	}
+	is := internal.Assert(t)
+	for _, tt := range []testcase{
+		{"", "                                   \"\""},
+		{"foo", "                                foo"},
+		{"a\\ b\\(c\\)\\/d\\\\", "           \"a b(c)/d\\\\\""},
+		{"/a\\/b\\\\\\\\/", "           /a\\/b\\\\\\\\/"},
+		{"NOT foo", "                            NOT foo"},
+		{"NOT NOT foo", "                        NOT NOT foo"},
+		{"NOT (a AND b)", "                      NOT (a AND b)"},
+		{"(NOT a) AND b", "                      NOT a AND b"},
+		{"a AND b OR c", "                       a AND b OR c"},
+		{"(a AND b) OR c", "                     a AND b OR c"},
+		{"a AND (b OR c)", "                     a AND (b OR c)"},
+		{"a OR (b OR c)", "                      a OR b OR c"},
+		{"((a)) AND ((b))", "                    a AND b"},
+		{"NOT (NOT a OR b) AND /c/", "           NOT (NOT a OR b) AND /c/"},
+		{"/AND/ OR /OR/ AND NOT /NOT/", "        /AND/ OR /OR/ AND NOT /NOT/"},
+		{"\"AND\" OR \"OR\" AND NOT \"NOT\"", "     \"AND\" OR \"OR\" AND NOT \"NOT\""},
+		{"\"a\\tb\" OR ~\"x y\" OR \"\" OR ~\\~", "\"a\\tb\" OR ~\"x y\" OR \"\" OR ~\"~\""},
+		{"\\\"a OR a\"b", "                        \"\\\"a\" OR a\"b"},
+		{"(a OR b) NEAR/2 c", "                  (a OR b) NEAR/2 c"},
+		{"((a)) BEFORE/1 (c OR d)", "            a BEFORE/1 (c OR d)"},
+		{"NOT (a NEAR/1 b) AND c", "             NOT (a NEAR/1 b) AND c"},
+		{"a THEN (b THEN c)", "                  a THEN b THEN c"},
+		{"a THEN (b OR c)", "                    a THEN (b OR c)"},
+		{"(a THEN b) AND c NEAR/1 d", "          a THEN b AND c NEAR/1 d"},
+		{"\"THEN\" THEN \"then\"", "               \"THEN\" THEN \"then\""},
+		{"a{2} OR \"a b\"{2,} OR /a/i{1,3}", "     a{2} OR \"a b\"{2,} OR /a/i{1,3}"},
+		{"\"a{2}\" OR a\\{2} OR {2}", "           \"a{2}\" OR \"a{2}\" OR \"{2}\""},
+		{"a XOR (b XOR c) OR d", "               a XOR b XOR c OR d"},
+		{"(a OR b) XOR c AND d", "               (a OR b) XOR c AND d"},
+		{"a IMPLIES (b IMPLIES c)", "            a IMPLIES b IMPLIES c"},
+		{"(a IMPLIES b) IMPLIES c", "            (a IMPLIES b) IMPLIES c"},
+		{"a OR b IMPLIES (c XOR d)", "           a OR b IMPLIES c XOR d"},
+		{"NOT (a IMPLIES b) XOR \"xor\"", "      NOT (a IMPLIES b) XOR \"xor\""},
+		{"ATLEAST 1 (a IMPLIES b, c OR d)", "    ATLEAST 1 (a IMPLIES b, c OR d)"},
+		{"ATLEAST 2 ((a), b OR c,NOT d)", "      ATLEAST 2 (a, b OR c, NOT d)"},
+		{"NOT ATMOST 0 (a) AND b", "             NOT ATMOST 0 (a) AND b"},
+		{"EXACTLY 1 (\"a,b\", a\\,b, \"ATLEAST\")", "EXACTLY 1 (\"a,b\", \"a,b\", \"ATLEAST\")"},
+	} {
+		want := strings.TrimSpace(tt.want)
+		is.Eqf(want, fmt.Sprint(MustCompile(tt.expr)), "matcher for %q", tt.expr)
+		node, err := ParseExpr(tt.expr)
+		is.NoErr(err)
+		is.Eqf(want, node.String(), "node for %q", tt.expr)
+	}
+}
+
+func TestLongChains(t *testing.T) {
+	is := internal.Assert(t)
+	var terms []string
+	for i := range 400 {
+		terms = append(terms, fmt.Sprintf("t%d", i))
+	}
+	m, err := Compile(strings.Join(terms, " OR "))
+	is.NoErr(err)
+	is.True(m.Match("t399"))
+	is.False(m.Match("x"))
+	plan, err := Explain(strings.Join(terms, " AND "))
+	is.NoErr(err)
+	is.True(strings.HasPrefix(plan, "AND['t0','t1','t2',"))
+	// nesting is still limited
+	expr := "a"
+	for i := range 25 {
+		if i%2 == 0 {
+			expr = fmt.Sprintf("b%d AND (%s)", i, expr)
+		} else {
+			expr = fmt.Sprintf("b%d OR (%s)", i, expr)
+		}
+	}
+	_, err = Compile(expr)
+	is.Eq("syntax error at column 166: too deep nesting level 21", fmt.Sprint(err))
+	// redundant parentheses do not count
+	expr = strings.Repeat("(", 30) + "a" + strings.Repeat(")", 30)
+	_, err = Compile(expr)
+	is.NoErr(err)
+}
+
+func TestCompileWithOptions(t *testing.T) {
+	type testcase struct {
+		expr string
+		opts Options
+		want string
+	}
+	is := internal.Assert(t)
+	for _, tt := range []testcase{
+		// MaxTokens
+		{"a OR b OR c", Options{}, "                    ok"},
+		{"a OR b OR c", Options{MaxTokens: 5}, "        ok"},
+		{"a OR b OR c", Options{MaxTokens: 4}, "        err: syntax error at column 11: too many tokens, maximum is 4"},
+		{"(a OR b) OR c", Options{MaxTokens: 4}, "      err: syntax error at column 8: too many tokens, maximum is 4"},
+		// MaxDepth
+		{"NOT NOT a", Options{MaxDepth: 2}, "                ok"},
+		{"NOT NOT NOT a", Options{MaxDepth: 2}, "            err: syntax error at column 13: too deep nesting level 3"},
+		{"a AND (b OR NOT c)", Options{MaxDepth: 2}, "       err: syntax error at column 17: too deep nesting level 3"},
+		{strings.Repeat("NOT ", 30) + "a", Options{MaxDepth: 30}, "ok"},
+		// MaxRegexSize
+		{"/abc/", Options{MaxRegexSize: 10}, "                  ok"},
+		{"a OR /a{1,20}/", Options{MaxRegexSize: 10}, "         err: syntax error at column 6: regex too large, size is 41, maximum is 10"},
+		{"/a(/", Options{MaxRegexSize: 10}, "                   err: syntax error at column 1: error parsing regexp: missing closing ): `a(`"},
+		// MaxLiterals
+		{"a OR /b/ OR c", Options{MaxLiterals: 3}, "           ok"},
+		{"a OR /b/ OR NOT (c AND d)", Options{MaxLiterals: 3}, "err: syntax error at column 24: too many literals, maximum is 3"},
+		// RejectEmpty
+		{"", Options{}, "                                  ok"},
+		{"   ", Options{RejectEmpty: true}, "              err: syntax error at column 4: empty expression"},
+		{"//", Options{RejectEmpty: true}, "               ok"},
+	} {
+		_, err := CompileWithOptions(tt.expr, tt.opts)
+		have := "ok"
+		if err != nil {
+			have = "err: " + err.Error()
+		}
+		is.Eqf(strings.TrimSpace(tt.want), have, "for %q with %+v", tt.expr, tt.opts)
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	is := internal.Assert(t)
+	testBmatch(t, Options{IgnoreCase: true}, []testcase{
+		{"ignoreCase1", "error", "'error'", []input{{"", false}, {"ERROR", true}, {"an Error", true}, {"erro", false}, {"eRrOr!", true}}},
+		{"ignoreCase2", "ERROR", "'ERROR'", []input{{"error", true}, {"ERROR", true}, {"ERR", false}}},
+		{"ignoreCase3", "/err(or)?/", "/err(or)?/", []input{{"ERR", true}, {"ErrOR", true}, {"er", false}}},
+		{"ignoreCase4", "Straße AND NOT grüße", "AND['Straße',NOT['grüße']]", []input{{"STRASSE", false}, {"straẞe", true}, {"STRAßE GRÜSSE", true}, {"STRAßE GRÜßE", false}}},
+		{"ignoreCase5", "kelvin", "'kelvin'", []input{{"\u212aelvin", true}, {"KELVIN", true}}},
+		{"ignoreCase6", "σ", "'σ'", []input{{"Σ", true}, {"ς", true}, {"s", false}}},
+		{"ignoreCase7", "", "''", []input{{"", true}, {"abc", true}}},
+	})
+	// spans refer to the input, even if the folded lengths differ, as for the Kelvin sign
+	m, err := CompileWithOptions("kelvin OR ab", Options{IgnoreCase: true})
+	is.NoErr(err)
+	is.Eq("[{0 8} {9 11} {12 14}]", fmt.Sprint(FindAll(m, "\u212aELVIN aB AB")))
+}
+
+func TestLiteralModifiers(t *testing.T) {
+	is := internal.Assert(t)
+	// FindAll reports the span of the shortest match for ungreedy regexes
+	is.Eq("[{0 1} {1 2}]", fmt.Sprint(FindAll(MustCompile("/a+/U"), "aa")))
+	// IgnoreCase adds the i flag
+	m, err := CompileWithOptions("/a/s OR /b/i", Options{IgnoreCase: true})
+	is.NoErr(err)
+	is.Eq("/a/si OR /b/i", fmt.Sprint(m))
+}
+
+func TestQuotedStrings(t *testing.T) {
+	is := internal.Assert(t)
+	_, err := CompileWithOptions(`""`, Options{RejectEmpty: true})
+	is.NoErr(err)
+}
+
+func TestWholeWords(t *testing.T) {
+	is := internal.Assert(t)
+	// occurrences within words are skipped
+	is.Eq("[{10 13} {19 22}]", fmt.Sprint(FindAll(MustCompile("word:cat"), "cats scat cat,cat_ cat")))
+	_, err := Compile("~word: x")
+	is.Eq("syntax error at column 1: missing literal after '~word:'", err.Error())
+	// the WholeWords option applies to all string literals, but not to regexes
+	m, err := CompileWithOptions("error OR ~warn OR /fatal/", Options{WholeWords: true})
+	is.NoErr(err)
+	is.Eq("word:error OR ~word:warn OR /fatal/", fmt.Sprint(m))
+	is.True(m.Match("fatality"))
+	is.True(m.Match("WARN: x"))
+	is.False(m.Match("errors warnings"))
+}
+
+func TestAnchors(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 4}]", fmt.Sprint(FindAll(MustCompile("^WARN"), "WARN WARN")))
+	is.Eq("[{5 9}]", fmt.Sprint(FindAll(MustCompile("~WARN$"), "WARN warn")))
+	is.Eq("[{0 9}]", fmt.Sprint(FindAll(MustCompile("^WARN\\ WARN$"), "WARN WARN")))
+	is.Eq("[]", fmt.Sprint(FindAll(MustCompile("^$"), "")))
+	m, err := CompileWithOptions("^a OR b$ OR ^c$", Options{IgnoreCase: true, WholeWords: true})
+	is.NoErr(err)
+	is.Eq("~word:^a OR ~word:b$ OR ~^c$", fmt.Sprint(m))
+	is.True(m.Match("A b"))
+	is.False(m.Match("ab"))
+}
+
+func TestGlob(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 5} {6 8}]", fmt.Sprint(FindAll(MustCompile("glob:a*b"), "axxab abbb")))
+	is.Eq("[{2 5}]", fmt.Sprint(FindAll(MustCompile("glob:*a?c*"), "x abc")))
+	_, err := Compile(`x OR glob:"a\\"`)
+	is.Eq(`syntax error at column 6: invalid glob pattern "a\\": trailing backslash`, err.Error())
+	// in glob mode, literals with unescaped wildcards are globs
+	opts := Options{Glob: true}
+	plan, err := ExplainWithOptions(`user-*-prod OR conn?ct OR what\? OR "a*"`, opts)
+	is.NoErr(err)
+	is.Eq(`OR['user-*-prod'g,'conn?ct'g,'what?','a*']`, plan)
+	m, err := CompileWithOptions(`user-*-prod OR what\?`, opts)
+	is.NoErr(err)
+	is.Eq(`glob:user-*-prod OR "what?"`, fmt.Sprint(m))
+	is.True(m.Match("user-1-prod"))
+	is.True(m.Match("what?"))
+	is.False(m.Match("whatx"))
+}
+
+func TestNear(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 7} {10 12}]", fmt.Sprint(FindAll(MustCompile("timeout NEAR/2 db"), "timeout x db y db z z db")))
+	is.Eq("[{7 14} {15 21}]", fmt.Sprint(FindAll(MustCompile("connect BEFORE/1 failed"), "failed connect failed x failed")))
+	is.Eq("[{0 1} {1 2} {3 4} {4 5}]", fmt.Sprint(FindAll(MustCompile("a NEAR/0 b"), "ab ba a b")))
+	// long lines full of operands take quadratic time if every pair of
+	// operand matches is compared
+	for _, tt := range []struct {
+		expr   string
+		unit   string // repeated to fill the line
+		result bool
+	}{
+		{"a NEAR/5 b", "a b ", true},
+		{"a BEFORE/5 b", "b a ", true},
+		{"a NEAR/1 b", "a x x b x x ", false},
+		{"a BEFORE/1 b", "b x a x x ", false},
+	} {
+		line := strings.Repeat(tt.unit, 64*1024/len(tt.unit))
+		m := MustCompile(tt.expr)
+		is.Eqf(tt.result, m.Match(line), "%s matches %q...", tt.expr, tt.unit)
+		is.Eqf(tt.result, len(FindAll(m, line)) > 0, "%s finds %q...", tt.expr, tt.unit)
+	}
+	_, err := Compile("a NEAR/x b")
+	is.Eq(`syntax error at column 3: invalid distance "NEAR/x"`, err.Error())
+	m, err := CompileWithOptions("a near/2 b and b before/3 c", Options{Dialect: ExtendedDialect})
+	is.NoErr(err)
+	is.Eq("a NEAR/2 b AND b BEFORE/3 c", fmt.Sprint(m))
+}
+
+func TestThen(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{7 14} {18 24}]", fmt.Sprint(FindAll(MustCompile("connect THEN failed"), "failed connect db failed")))
+}
+
+func TestCount(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 1} {2 3}]", fmt.Sprint(FindAll(MustCompile("a{2}"), "a a")))
+	is.Eq("[]", fmt.Sprint(FindAll(MustCompile("a{0}"), "b")))
+	node, err := ParseExpr("x AND foo{2,}")
+	is.NoErr(err)
+	count := node.(*ast.AndExpr).Operands[1].(*ast.CountExpr)
+	is.Eq("6-13 2 -1", fmt.Sprintf("%d-%d %d %d", count.Pos(), count.End(), count.Min, count.Max))
+	is.Eq("6-9", fmt.Sprintf("%d-%d", count.X.Pos(), count.X.End()))
+	// counting stops at the limit
+	is.Eq(2, occurrences(&stringMatcher{"a"}, "aaaa", 2))
+	is.Eq(4, occurrences(&stringMatcher{"a"}, "aaaa", 5))
+	is.Eq(3, occurrences(MustCompile("/a/"), "aaaa", 3))
+	is.Eq(1, occurrences(MustCompile("word:a"), "a b a", 1))
+}
+
+func TestXorImplies(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 1} {2 3} {4 5}]", fmt.Sprint(FindAll(MustCompile("a XOR b XOR c"), "a b c")))
+	is.True(FindAll(MustCompile("a XOR b XOR c"), "a b") == nil)
+	is.Eq("[{0 5} {6 14}]", fmt.Sprint(FindAll(MustCompile("retry IMPLIES attempt="), "retry attempt=2")))
+	is.Eq("[]", fmt.Sprint(FindAll(MustCompile("retry IMPLIES attempt="), "ok")))
+}
+
+func TestThreshold(t *testing.T) {
+	is := internal.Assert(t)
+	is.Eq("[{0 3} {8 11}]", fmt.Sprint(FindAll(MustCompile("ATLEAST 2 (foo, bar, baz)"), "foo and baz")))
+	is.True(FindAll(MustCompile("ATMOST 1 (foo, bar, baz)"), "foo and baz") == nil)
+	is.Eq("[{4 7}]", fmt.Sprint(FindAll(MustCompile("ATMOST 1 (foo, bar, baz)"), "and bar")))
+	_, err := Compile("ATLEAST 3 (a, b)")
+	is.Eq("syntax error at column 1: count 3 exceeds number of operands 2", err.Error())
+	_, err = Compile("ATLEAST (a, b)")
+	is.Eq("syntax error at column 1: missing count after 'ATLEAST'", err.Error())
+	// the result is decided without evaluating the remaining operands
+	var calls int
+	count := func(result bool) Matcher { return countingMatcher{&calls, result} }
+	for _, tt := range []struct {
+		m     Matcher
+		calls int
+	}{
+		{&thresholdMatcher{"ATLEAST", 2, []Matcher{count(true), count(true), count(true), count(true)}}, 2},
+		{&thresholdMatcher{"ATLEAST", 2, []Matcher{count(false), count(false), count(false), count(true)}}, 3},
+		{&thresholdMatcher{"ATMOST", 1, []Matcher{count(true), count(true), count(true)}}, 2},
+		{&thresholdMatcher{"ATMOST", 3, []Matcher{count(true), count(true), count(true)}}, 0},
+		{&thresholdMatcher{"EXACTLY", 1, []Matcher{count(false), count(false), count(true)}}, 3},
+	} {
+		calls = 0
+		tt.m.Match("")
+		is.Eqf(tt.calls, calls, "calls of %v", tt.m)
+	}
+}
+
+// A countingMatcher counts its calls and returns a fixed result.
+type countingMatcher struct {
+	calls  *int
+	result bool
+}
+
+func (m countingMatcher) Match(string) bool {
+	*m.calls++
+	return m.result
+}
+
+func TestDefinitions(t *testing.T) {
+	is := internal.Assert(t)
+	defs := map[string]string{
+		"noise":   "healthcheck OR /GET \\/metrics/",
+		"failure": "error OR fatal",
+		"alert":   "$failure AND NOT $noise",
+		"a":       "x OR $b",
+		"b":       "y AND $a",
+		"self":    "NOT $self",
+		"bad":     "x AND",
+		"badre":   "/a(/",
+	}
+	opts := Options{Definitions: defs}
+	for _, tt := range []struct {
+		expr string
+		plan string
+		want string
+	}{
+		{"error AND NOT $noise", "AND['error',NOT[OR['healthcheck',/GET /metrics/]]]", "error AND NOT (healthcheck OR /GET \\/metrics/)"},
+		{"$alert", "               AND[OR['error','fatal'],NOT[OR['healthcheck',/GET /metrics/]]]", "(error OR fatal) AND NOT (healthcheck OR /GET \\/metrics/)"},
+		{"ATLEAST 1 ($noise, x)", "ATLEAST 1[OR['healthcheck',/GET /metrics/],'x']", "ATLEAST 1 (healthcheck OR /GET \\/metrics/, x)"},
+		{"\\$noise OR \"$x\"", "    OR['$noise','$x']", "\"$noise\" OR \"$x\""},
+	} {
+		plan, err := ExplainWithOptions(tt.expr, opts)
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.plan), plan, "plan for %q", tt.expr)
+		m, err := CompileWithOptions(tt.expr, opts)
+		is.NoErr(err)
+		is.Eqf(tt.want, fmt.Sprint(m), "matcher for %q", tt.expr)
+	}
+	m, err := CompileWithOptions("$alert", opts)
+	is.NoErr(err)
+	is.True(m.Match("fatal: disk full"))
+	is.False(m.Match("error in healthcheck"))
+	is.False(m.Match("GET /metrics"))
+	// the syntax tree keeps the references
+	node, err := ParseExprWithOptions("x OR $alert", opts)
+	is.NoErr(err)
+	is.Eq("x OR $alert", node.String())
+	ref := node.(*ast.OrExpr).Operands[1].(*ast.RefExpr)
+	is.Eq("alert 5 11", fmt.Sprintf("%s %d %d", ref.Name, ref.Pos(), ref.End()))
+	is.Eq("$failure AND NOT $noise", ref.X.String())
+	// errors
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"$missing", "        syntax error at column 1: undefined name $missing"},
+		{"x OR $a", "         syntax error at column 6: in $a at column 6: in $b at column 7: cyclic definition $a -> $b -> $a"},
+		{"$self", "           syntax error at column 1: in $self at column 5: cyclic definition $self -> $self"},
+		{"$bad", "            syntax error at column 1: in $bad at column 6: unexpected end of expression, expected literal, \"(\", \"NOT\", \"ATLEAST\", \"EXACTLY\" or \"ATMOST\""},
+		{"x AND $badre", "    syntax error at column 7: in $badre at column 1: error parsing regexp: missing closing ): `a(`"},
+		{"~$noise", "         syntax error at column 1: invalid modifier for reference \"~$noise\""},
+	} {
+		_, err := CompileWithOptions(tt.expr, opts)
+		is.Eqf(strings.TrimSpace(tt.want), fmt.Sprint(err), "error for %q", tt.expr)
+	}
+	// limits apply to the expanded expression
+	_, err = CompileWithOptions("$alert", Options{Definitions: defs, MaxLiterals: 3})
+	is.Eq("syntax error at column 1: too many literals, maximum is 3", fmt.Sprint(err))
+	// without definitions, references are string literals
+	is.True(MustCompile("$noise").Match("$noise"))
+}
+
+func TestPrepare(t *testing.T) {
+	is := internal.Assert(t)
+	tmpl, err := Prepare("user-42 AND level:? AND ?")
+	is.NoErr(err)
+	is.Eq(2, tmpl.NumParams())
+	is.Eq("user-42 AND level:? AND ?", tmpl.String())
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"warn", "timeout"}, "      user-42 AND level:warn AND timeout"},
+		{[]string{"warn", "x OR y"}, "       user-42 AND level:warn AND \"x OR y\""},
+		{[]string{"warn", ") OR (x"}, "      user-42 AND level:warn AND \") OR (x\""},
+		{[]string{"NOT", "/a/i"}, "          user-42 AND level:NOT AND \"/a/i\""},
+		{[]string{"warn", "$name"}, "        user-42 AND level:warn AND \"$name\""},
+		{[]string{"", "warn"}, "             user-42 AND level: AND warn"},
+	} {
+		m, err := tmpl.Bind(tt.args...)
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.want), fmt.Sprint(m), "matcher for %q", tt.args)
+		m2 := MustCompile(fmt.Sprint(m))
+		is.Eqf(fmt.Sprint(m), fmt.Sprint(m2), "round trip for %q", tt.args)
+	}
+	m, err := tmpl.Bind("warn", "x OR y")
+	is.NoErr(err)
+	is.True(m.Match("user-42 level:warn: x OR y"))
+	is.False(m.Match("user-42 level:warn: x"))
+	// values are bytes, not necessarily valid UTF-8
+	m, err = tmpl.Bind("warn", "\xff")
+	is.NoErr(err)
+	is.True(m.Match("user-42 level:warn \xff"))
+	is.False(m.Match("user-42 level:warn \uFFFD"))
+	// modifiers, options and definitions
+	tmpl, err = PrepareWithOptions(`~word:? OR glob:?-* OR $d OR \? OR "?"`, Options{Definitions: map[string]string{"d": "d?"}})
+	is.NoErr(err)
+	is.Eq(2, tmpl.NumParams())
+	m, err = tmpl.Bind("A*B", "x?")
+	is.NoErr(err)
+	is.Eq(`~word:"A*B" OR glob:"x\\?-*" OR "d?" OR "?" OR "?"`, fmt.Sprint(m))
+	is.True(m.Match("an a*b c"))
+	is.False(m.Match("an aXb c"))
+	is.True(m.Match("x?-1"))
+	is.False(m.Match("xy-1"))
+	// errors
+	_, err = tmpl.Bind("a")
+	is.Eq("got 1 arguments for 2 placeholders", fmt.Sprint(err))
+	// an empty value for a standalone placeholder would match everything
+	tmpl, err = Prepare("user-42 AND ?")
+	is.NoErr(err)
+	_, err = tmpl.Bind("")
+	is.Eq("syntax error at column 13: empty value for placeholder", fmt.Sprint(err))
+	_, err = Prepare("? AND")
+	is.Eq(`syntax error at column 6: unexpected end of expression, expected literal, "(", "NOT", "ATLEAST", "EXACTLY" or "ATMOST"`, fmt.Sprint(err))
+	_, err = Prepare("ATLEAST ? (a, b)")
+	is.Eq(`syntax error at column 9: invalid count "?"`, fmt.Sprint(err))
+	// without Prepare, '?' is a plain character
+	is.True(MustCompile("a?").Match("a?"))
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	is := internal.Assert(t)
+	for _, str := range []string{"a", "a b", "x) OR (y", "AND", "and", "~a", "$a", "a{2}", "a,b", "a*?", "-a", "", "\xff", "a\xc3"} {
+		for _, opts := range []Options{{}, {Dialect: ExtendedDialect}, {Glob: true}, {Definitions: map[string]string{"a": "x"}}} {
+			m, err := CompileWithOptions("ATLEAST 1 ("+QuoteLiteral(str)+")", opts)
+			is.NoErr(err)
+			is.Eqf("ATLEAST 1 ("+QuoteLiteral(str)+")", fmt.Sprint(m), "QuoteLiteral(%q)", str)
+			is.Eqf(true, m.Match("<"+str+">"), "QuoteLiteral(%q) %+v", str, opts)
+		}
+	}
+	is.Eq(`"x) OR (y"`, QuoteLiteral("x) OR (y"))
+	is.Eq(`abc`, QuoteLiteral("abc"))
+	is.Eq(`"\xff"`, QuoteLiteral("\xff"))
+	m := MustCompile(QuoteLiteral("\xff"))
+	is.True(m.Match("\xff"))
+	is.False(m.Match("\uFFFD"))
+}
+
+// A lengthMatcher is a user-defined matcher that matches strings of at
+// least a given length.
+type lengthMatcher int
+
+func (m lengthMatcher) Match(str string) bool {
+	return len(str) >= int(m)
+}
+
+func (m lengthMatcher) String() string {
+	return fmt.Sprintf("glob:%s*", strings.Repeat("?", int(m)))
+}
+
+func TestConstructors(t *testing.T) {
+	is := internal.Assert(t)
+	for _, tt := range []struct {
+		m    Matcher
+		want string
+	}{
+		{Literal("a b"), "                                         \"a b\""},
+		{Literal("AND"), "                                         \"AND\""},
+		{Literal("\xff"), "                                        \"\\xff\""},
+		{Regex(regexp.MustCompile("(?i)a/b")), "                   /(?i)a\\/b/"},
+		{And(Literal("a"), Or(Literal("b"), Literal("c"))), "     a AND (b OR c)"},
+		{Or(Literal("a"), And(Literal("b"), Not(Literal("c")))), "a OR b AND NOT c"},
+		{Not(Or(Literal("a"), Literal("b"))), "                    NOT (a OR b)"},
+		{And(MustCompile("a OR b"), Literal("c")), "               (a OR b) AND c"},
+		{And(Literal("a"), lengthMatcher(3)), "                   a AND glob:???*"},
+		{And(Literal("a")), "                                      a"},
+		{And(), "                                                  \"\""},
+		{Or(), "                                                   NOT \"\""},
+	} {
+		is.Eq(strings.TrimSpace(tt.want), fmt.Sprint(tt.m))
+		is.Eq(strings.TrimSpace(tt.want), fmt.Sprint(MustCompile(fmt.Sprint(tt.m))))
+	}
+	m := And(Regex(regexp.MustCompile("[0-9]+")), Not(Literal("error")), lengthMatcher(5))
+	is.True(m.Match("id 42"))
+	is.False(m.Match("id 4"))
+	is.False(m.Match("error 42"))
+	is.False(m.Match("id: x"))
+	is.Eq("[{3 5}]", fmt.Sprint(FindAll(m, "id 42")))
+	is.True(And().Match("x"))
+	is.False(Or().Match("x"))
+	is.True(MustCompile(fmt.Sprint(Literal("\xff"))).Match("\xff"))
+	// operands are copied
+	ms := []Matcher{Literal("a"), Literal("b")}
+	m = Or(ms...)
+	ms[0] = Literal("c")
+	is.Eq("a OR b", fmt.Sprint(m))
+}
+
+func TestFuncs(t *testing.T) {
+	is := internal.Assert(t)
+	vips := map[string][]string{"gold": {"alice"}, "silver": {"bob", "carol"}}
+	funcs := map[string]Func{
+		"even": Predicate(func(str string) bool { return len(str)%2 == 0 }),
+		"vip": func(args []string) (Matcher, error) {
+			var ms []Matcher
+			for _, arg := range args {
+				names, ok := vips[arg]
+				if !ok {
+					return nil, fmt.Errorf("unknown level %q", arg)
+				}
+				for _, name := range names {
+					ms = append(ms, Literal(name))
+				}
+			}
+			return Or(ms...), nil
+		},
+	}
+	opts := Options{Funcs: funcs, Definitions: map[string]string{"gold": "@vip(gold)"}}
+	for _, tt := range []struct {
+		expr string
+		plan string
+		want string
+	}{
+		{"@even AND @vip(gold, silver)", "   AND[@even,@vip(gold, silver)]", "@even AND @vip(gold, silver)"},
+		{"NOT @vip( \"gold\" )", "             NOT[@vip(gold)]", "                NOT @vip(gold)"},
+		{"$gold OR \"@even\" OR \\@even", "      OR[@vip(gold),'@even','@even']", "@vip(gold) OR \"@even\" OR \"@even\""},
+	} {
+		plan, err := ExplainWithOptions(tt.expr, opts)
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.plan), plan, "plan for %q", tt.expr)
+		m, err := CompileWithOptions(tt.expr, opts)
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.want), fmt.Sprint(m), "matcher for %q", tt.expr)
+	}
+	m, err := CompileWithOptions("@even AND @vip(silver)", opts)
+	is.NoErr(err)
+	is.True(m.Match("to bob"))
+	is.False(m.Match("to bob!"))
+	is.False(m.Match("to al"))
+	is.Eq("[{3 6}]", fmt.Sprint(FindAll(m, "to bob")))
+	node, err := ParseExprWithOptions("x OR @vip(gold)", opts)
+	is.NoErr(err)
+	call := node.(*ast.OrExpr).Operands[1].(*ast.CallExpr)
+	is.Eq("vip [gold] 5 15", fmt.Sprintf("%s %s %d %d", call.Name, call.Args, call.Pos(), call.End()))
+	// errors
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"@missing", "           syntax error at column 1: unknown function @missing"},
+		{"x AND @vip(platinum)", "syntax error at column 7: invalid call @vip(platinum): unknown level \"platinum\""},
+		{"@even(x)", "           syntax error at column 1: invalid call @even(x): too many arguments"},
+		{"@vip(gold", "          syntax error at column 5: unclosed argument list"},
+		{"x NEAR/1 @even", "     syntax error at column 10: invalid operand @even of NEAR/1: it must be a literal or an OR of literals that match non-empty text"},
+		{"x THEN @even", "       syntax error at column 8: invalid operand @even of THEN: it must be a literal or an OR of literals that match non-empty text"},
+	} {
+		_, err := CompileWithOptions(tt.expr, opts)
+		is.Eqf(strings.TrimSpace(tt.want), fmt.Sprint(err), "error for %q", tt.expr)
+	}
+	_, err = CompileWithOptions("@even OR @even", Options{Funcs: funcs, MaxLiterals: 1})
+	is.Eq("syntax error at column 10: too many literals, maximum is 1", fmt.Sprint(err))
+	// without funcs, calls are string literals
+	is.True(MustCompile("@even").Match("@even"))
+}
+
+func TestImplicitAnd(t *testing.T) {
+	is := internal.Assert(t)
+	opts := Options{ImplicitAnd: true}
+	plan, err := ExplainWithOptions(`little cat OR "big dog" NOT /cow/`, opts)
+	is.NoErr(err)
+	is.Eq("OR[AND['little','cat'],AND['big dog',NOT[/cow/]]]", plan)
+	m, err := CompileWithOptions("foo bar", opts)
+	is.NoErr(err)
+	is.True(m.Match("bar foo"))
+	is.False(m.Match("foo"))
+	is.Eq("foo AND bar", fmt.Sprint(m))
+	_, err = Compile("foo bar")
+	is.Eq(`syntax error at column 5: unexpected "bar", expected "AND", "OR", "XOR", "IMPLIES", "NEAR/n", "BEFORE/n", "THEN" or end of expression`, err.Error())
+	_, err = ExplainWithOptions("foo bar", Options{})
+	is.Eq(`syntax error at column 5: unexpected "bar", expected "AND", "OR", "XOR", "IMPLIES", "NEAR/n", "BEFORE/n", "THEN" or end of expression`, err.Error())
+}
+
+func TestExtendedDialect(t *testing.T) {
+	type testcase struct {
+		expr string
+		plan string
+	}
+	is := internal.Assert(t)
+	for _, tt := range []testcase{
+		{"a && b || !c", "                      OR[AND['a','b'],NOT['c']]"},
+		{"a and (b or not c)", "                AND['a',OR['b',NOT['c']]]"},
+		{"a AND b OR NOT c", "                  OR[AND['a','b'],NOT['c']]"},
+		{"+error -debug +/time.?out/", "        AND['error',NOT['debug'],/time.?out/]"},
+		{"level:warn !(healthcheck || ping)", " AND['level:warn',NOT[OR['healthcheck','ping']]]"},
+		{"\\-5 \"and\" -", "                      AND['-5','and','-']"},
+		{"a&&b", "                              AND['a','b']"},
+		{"(a||b) c&&\"d||e\"", "                AND[OR['a','b'],'c','d||e']"},
+	} {
+		plan, err := ExplainWithOptions(tt.expr, Options{Dialect: ExtendedDialect, ImplicitAnd: true})
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.plan), plan, "plan for %q", tt.expr)
+		// the canonical form uses the default dialect
+		m, err := CompileWithOptions(tt.expr, Options{Dialect: ExtendedDialect, ImplicitAnd: true})
+		is.NoErr(err)
+		plan, err = Explain(fmt.Sprint(m))
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.plan), plan, "plan for %q", fmt.Sprint(m))
+	}
+	plan, err := Explain("a && b")
+	is.Eq("", plan)
+	is.Eq(`syntax error at column 3: unexpected "&&", expected "AND", "OR", "XOR", "IMPLIES", "NEAR/n", "BEFORE/n", "THEN" or end of expression`, err.Error())
+}
@@ -0,0 +1,299 @@
+package bmatch
+
+import (
+	"errors"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A BuiltinFunc describes a built-in function, see Options.Builtins.
+type BuiltinFunc struct {
+	Name string // the name, without '@'
+	Doc  string // a short description
+}
+
+// BuiltinFuncs returns the built-in functions, sorted by name.
+func BuiltinFuncs() []BuiltinFunc {
+	funcs := make([]BuiltinFunc, len(builtins))
+	for i, b := range builtins {
+		funcs[i] = BuiltinFunc{b.name, b.doc}
+	}
+	return funcs
+}
+
+// A builtin is a built-in function. Without arguments, it matches if the
+// input contains a candidate that rex finds and accept accepts. With
+// arguments, fn returns the matcher.
+type builtin struct {
+	name string
+	doc  string
+	fn   Func // nil for functions without arguments
+	rex  *regexp.Regexp
+	// accept returns the valid prefix of a candidate, or "" if there
+	// is none.
+	accept func(candidate string) string
+	// seps are the characters that may join the token with adjacent
+	// word characters, so they must not be next to the token if they
+	// are next to a word character, e.g. "." for '1.2.3.4.5'.
+	seps string
+}
+
+// builtins are the built-in functions, sorted by name.
+var builtins = []*builtin{
+	{
+		name:   "email",
+		doc:    "an email address, like alice@example.com",
+		rex:    regexp.MustCompile("[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+(?:\\.[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+)*@[A-Za-z0-9-]+(?:\\.[A-Za-z0-9-]+)+"),
+		accept: acceptEmail,
+	},
+	{
+		name:   "hexhash",
+		doc:    "a hex-encoded MD5, SHA-1, SHA-256 or SHA-512 hash, in lower or upper case",
+		rex:    regexp.MustCompile("[0-9A-Fa-f]{32,128}"),
+		accept: acceptHexHash,
+	},
+	{
+		name: "ip",
+		doc:  "an IPv4 or IPv6 address in one of the given prefixes, ranges or addresses, like @ip(10.0.0.0/8, 192.168.0.1-192.168.0.99, ::1)",
+		fn:   newIPMatcher,
+	},
+	ipv4Builtin,
+	ipv6Builtin,
+	{
+		name:   "isodate",
+		doc:    "an ISO 8601 date, like 2024-01-31, optionally with time and zone, like 2024-01-31T12:00:00Z",
+		rex:    regexp.MustCompile(`[0-9]{4}-[0-9]{2}-[0-9]{2}(?:[T ][0-9]{2}:[0-9]{2}(?::[0-9]{2}(?:\.[0-9]+)?)?(?:Z|[+-][0-9]{2}:?[0-9]{2})?)?`),
+		accept: acceptISODate,
+		seps:   "-",
+	},
+	{
+		name:   "url",
+		doc:    "an http, https, ftp, ftps, ws or wss URL, like https://example.com/path",
+		rex:    regexp.MustCompile(`(?i)\b(?:https?|ftps?|wss?)://[^\s<>"]+`),
+		accept: acceptURL,
+	},
+	{
+		name:   "uuid",
+		doc:    "a UUID, like 123e4567-e89b-12d3-a456-426614174000",
+		rex:    regexp.MustCompile(`[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}`),
+		accept: func(candidate string) string { return candidate },
+	},
+}
+
+var ipv4Builtin = &builtin{
+	name:   "ipv4",
+	doc:    "an IPv4 address, like 192.168.0.1",
+	rex:    regexp.MustCompile(`[0-9]{1,3}(?:\.[0-9]{1,3}){3}`),
+	accept: acceptIPv4,
+	seps:   ".",
+}
+
+var ipv6Builtin = &builtin{
+	name:   "ipv6",
+	doc:    "an IPv6 address, like 2001:db8::1 or ::ffff:192.168.0.1",
+	rex:    regexp.MustCompile(`[0-9A-Fa-f:]*:(?:[0-9]{1,3}(?:\.[0-9]{1,3}){3}|[0-9A-Fa-f:]*)`),
+	accept: acceptIPv6,
+	seps:   ":",
+}
+
+// lookupBuiltin returns the built-in function with the given name.
+func lookupBuiltin(name string) (Func, bool) {
+	for _, b := range builtins {
+		if b.name == name {
+			return b.call, true
+		}
+	}
+	return nil, false
+}
+
+func (b *builtin) call(args []string) (Matcher, error) {
+	if b.fn != nil {
+		return b.fn(args)
+	}
+	if len(args) > 0 {
+		return nil, errors.New("too many arguments")
+	}
+	return &builtinMatcher{b}, nil
+}
+
+// A builtinMatcher matches if the input contains a token of a builtin.
+type builtinMatcher struct {
+	b *builtin
+}
+
+func (m *builtinMatcher) Match(str string) bool {
+	_, ok := m.next(str, 0)
+	return ok
+}
+
+func (m *builtinMatcher) String() string {
+	return "@" + m.b.name
+}
+
+func (m *builtinMatcher) find(str string, spans []Span) ([]Span, bool) {
+	found := false
+	offset := 0
+	for {
+		span, ok := m.next(str, offset)
+		if !ok {
+			return spans, found
+		}
+		found = true
+		spans = append(spans, span)
+		offset = span.End
+	}
+}
+
+// next returns the first token in str at or after offset.
+func (m *builtinMatcher) next(str string, offset int) (Span, bool) {
+	for offset <= len(str) {
+		loc := m.b.rex.FindStringIndex(str[offset:])
+		if loc == nil {
+			return Span{}, false
+		}
+		start, end := offset+loc[0], offset+loc[1]
+		if token := m.b.accept(str[start:end]); token != "" && isolated(str, start, start+len(token), m.b.seps) {
+			return Span{start, start + len(token)}, true
+		}
+		// try again after the rejected candidate, not inside it, since
+		// retrying inside a long candidate would take quadratic time
+		offset = max(end, start+1)
+	}
+	return Span{}, false
+}
+
+// isolated reports whether str[start:end] is a token on its own: it must
+// neither be preceded nor followed by a word character, or by one of seps
+// that is itself next to a word character.
+func isolated(str string, start, end int, seps string) bool {
+	before, size := utf8.DecodeLastRuneInString(str[:start])
+	if isWordChar(before) {
+		return false
+	}
+	if strings.ContainsRune(seps, before) {
+		if r, _ := utf8.DecodeLastRuneInString(str[:start-size]); isWordChar(r) {
+			return false
+		}
+	}
+	after, size := utf8.DecodeRuneInString(str[end:])
+	if isWordChar(after) {
+		return false
+	}
+	if strings.ContainsRune(seps, after) {
+		if r, _ := utf8.DecodeRuneInString(str[end+size:]); isWordChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptEmail(candidate string) string {
+	addr, err := mail.ParseAddress(candidate)
+	if err != nil || addr.Address != candidate {
+		return ""
+	}
+	local, domain, _ := strings.Cut(candidate, "@")
+	if len(local) > 64 || len(domain) > 253 {
+		return ""
+	}
+	labels := strings.Split(domain, ".")
+	for _, label := range labels {
+		if len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return ""
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		// the top-level domain is not numeric
+		return ""
+	}
+	return candidate
+}
+
+func acceptHexHash(candidate string) string {
+	switch len(candidate) {
+	case 32, 40, 64, 128:
+	default:
+		return ""
+	}
+	lower := strings.ContainsAny(candidate, "abcdef")
+	upper := strings.ContainsAny(candidate, "ABCDEF")
+	if lower == upper {
+		// no letters, like a long number, or mixed case
+		return ""
+	}
+	return candidate
+}
+
+func acceptIPv4(candidate string) string {
+	// ParseAddr rejects octets above 255 and leading zeros
+	if addr, err := netip.ParseAddr(candidate); err != nil || !addr.Is4() {
+		return ""
+	}
+	return candidate
+}
+
+func acceptIPv6(candidate string) string {
+	if strings.Trim(candidate, ":.") == "" {
+		// '::' is a valid address, but rather a separator in text
+		return ""
+	}
+	if addr, err := netip.ParseAddr(candidate); err == nil && addr.Is6() {
+		return candidate
+	}
+	// the candidate may end with punctuation, like in 'at ::1.' or '::1: error'
+	candidate = strings.TrimRight(candidate, ".:")
+	if addr, err := netip.ParseAddr(candidate); err == nil && addr.Is6() {
+		return candidate
+	}
+	return ""
+}
+
+func acceptISODate(candidate string) string {
+	date := candidate[:len(time.DateOnly)]
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		return ""
+	}
+	if len(candidate) == len(date) {
+		return date
+	}
+	clock := candidate[len(date)+1:]
+	layout := "15:04"
+	if len(clock) > 5 && clock[5] == ':' {
+		layout += ":05" // the fraction is accepted without layout
+	}
+	if i := strings.IndexAny(clock, "Z+-"); i >= 0 {
+		if clock[i] == 'Z' || strings.Contains(clock[i:], ":") {
+			layout += "Z07:00"
+		} else {
+			layout += "Z0700"
+		}
+	}
+	if _, err := time.Parse(layout, clock); err != nil {
+		// an invalid time does not make the date invalid
+		return date
+	}
+	return candidate
+}
+
+func acceptURL(candidate string) string {
+	// trailing punctuation belongs to the surrounding text, unless it
+	// closes a parenthesis of the URL, like in 'https://w.org/a_(b)'
+	for candidate != "" && strings.ContainsRune(".,;:!?'\")]", rune(candidate[len(candidate)-1])) {
+		last := candidate[len(candidate)-1]
+		if last == ')' && strings.Count(candidate, "(") >= strings.Count(candidate, ")") ||
+			last == ']' && strings.Count(candidate, "[") >= strings.Count(candidate, "]") {
+			break
+		}
+		candidate = candidate[:len(candidate)-1]
+	}
+	u, err := url.Parse(candidate)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	return candidate
+}
@@ -0,0 +1,188 @@
+package bmatch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cvilsmeier/bmatch/internal"
+)
+
+func TestBuiltins(t *testing.T) {
+	is := internal.Assert(t)
+	for _, tt := range []struct {
+		expr string
+		str  string
+		want string // the found tokens, separated by '|'
+	}{
+		// email
+		{"@email", "mail alice@example.com now", "              alice@example.com"},
+		{"@email", "<bob.smith+tag@mail.example.org>.", "      bob.smith+tag@mail.example.org"},
+		{"@email", "a@b.com, c@d.de", "                         a@b.com|c@d.de"},
+		{"@email", "alice@localhost", "                         "},
+		{"@email", "alice@1.2.3.4", "                           "},
+		{"@email", "alice@-example.com", "                      "},
+		{"@email", ".alice@example.com", "                      alice@example.com"},
+		{"@email", "alice..b@example.com", "                    b@example.com"},
+		{"@email", "@example.com", "                            "},
+		// hexhash
+		{"@hexhash", "md5 d41d8cd98f00b204e9800998ecf8427e", "        d41d8cd98f00b204e9800998ecf8427e"},
+		{"@hexhash", "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709", "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"},
+		{"@hexhash", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"@hexhash", "d41d8cd98f00b204e9800998ecf8427", "             "},
+		{"@hexhash", "d41d8cd98f00b204e9800998ecf8427ea", "           "},
+		{"@hexhash", "xd41d8cd98f00b204e9800998ecf8427e", "           "},
+		{"@hexhash", "12345678901234567890123456789012", "            "},
+		{"@hexhash", "d41d8cd98f00b204e9800998ECF8427E", "            "},
+		// ipv4
+		{"@ipv4", "from 192.168.0.1:8080 to 10.0.0.255.", "     192.168.0.1|10.0.0.255"},
+		{"@ipv4", "0.0.0.0 255.255.255.255", "                 0.0.0.0|255.255.255.255"},
+		{"@ipv4", "256.1.1.1 1.2.3 01.2.3.4", "                "},
+		{"@ipv4", "1.2.3.4.5 v1.2.3.4 1.2.3.4a", "             "},
+		{"@ipv4", "::ffff:1.2.3.4", "                          1.2.3.4"},
+		// ipv6
+		{"@ipv6", "from 2001:db8::1 to ::1.", "                 2001:db8::1|::1"},
+		{"@ipv6", "[fe80::1ff:fe23:4567:890a]:443", "           fe80::1ff:fe23:4567:890a"},
+		{"@ipv6", "::ffff:192.168.0.1 fe80::", "                ::ffff:192.168.0.1|fe80::"},
+		{"@ipv6", "2001:0db8:0000:0000:0000:ff00:0042:8329", " 2001:0db8:0000:0000:0000:ff00:0042:8329"},
+		{"@ipv6", "at 12:30:45 from 00:1a:2b:3c:4d:5e", "      "},
+		{"@ipv6", "1:2:3:4:5:6:7:8:9 ::g x2001:db8::1", "       "},
+		{"@ipv6", "host ::1: error", "                         ::1"},
+		{"@ipv6", "a :: b std::vector Foo::Bar", "             "},
+		// ip
+		{"@ip(10.0.0.0/8)", "from 10.1.2.3 to 192.168.0.1 and 10.255.255.255", "10.1.2.3|10.255.255.255"},
+		{"@ip(10.0.0.0/8)", "from 11.0.0.0 or 9.255.255.255 or 010.0.0.1", "  "},
+		{"@ip(192.168.0.0/16, fd00::/8)", "a 192.168.7.1 b fd12::1 c fe80::1", "192.168.7.1|fd12::1"},
+		{"@ip(192.168.1.10/24)", "at 192.168.1.255, not 192.168.2.0", "    192.168.1.255"},
+		{"@ip(10.0.0.5-10.0.1.2)", "10.0.0.4 10.0.0.5 10.0.0.200 10.0.1.2 10.0.1.3", "10.0.0.5|10.0.0.200|10.0.1.2"},
+		{"@ip(::1, 127.0.0.1)", "[::1]:80 127.0.0.1 127.0.0.2 ::2", "                ::1|127.0.0.1"},
+		{"@ip(10.0.0.0/8)", "mapped ::ffff:10.0.0.1", "                          ::ffff:10.0.0.1"},
+		{"@ip(::ffff:0:0/96)", "mapped ::ffff:10.0.0.1 and 10.0.0.2", "            ::ffff:10.0.0.1"},
+		{"@ip(0.0.0.0/0)", "any 1.2.3.4 but not 2001:db8::1", "               1.2.3.4"},
+		{"@ip(::/0)", "any 1.2.3.4 but not 2001:db8::1", "                    2001:db8::1"},
+		{"@ip(10.0.0.0/8)", "10.1.2.3.4 v10.1.2.3 10.1.2.3a", "                 "},
+		// isodate
+		{"@isodate", "on 2024-01-31, and 2024-02-29.", "           2024-01-31|2024-02-29"},
+		{"@isodate", "at 2024-01-31T12:00:00Z", "                  2024-01-31T12:00:00Z"},
+		{"@isodate", "at 2024-01-31T12:00:00.123+02:00", "         2024-01-31T12:00:00.123+02:00"},
+		{"@isodate", "at 2024-01-31 23:59-0500", "                 2024-01-31 23:59-0500"},
+		{"@isodate", "at 2024-01-31 24:00:00", "                   2024-01-31"},
+		{"@isodate", "2023-02-29 2024-13-01 2024-01-32", "         "},
+		{"@isodate", "12024-01-31 2024-01-31-1 v2024-01-31", "     "},
+		// url
+		{"@url", "see https://example.com/a?b=c#d.", "               https://example.com/a?b=c#d"},
+		{"@url", "(http://example.com) and ftp://ftp.example.org/x", "http://example.com|ftp://ftp.example.org/x"},
+		{"@url", "https://en.wikipedia.org/wiki/Go_(language)!", "https://en.wikipedia.org/wiki/Go_(language)"},
+		{"@url", "HTTPS://EXAMPLE.COM wss://x.io:8443/ws", "       HTTPS://EXAMPLE.COM|wss://x.io:8443/ws"},
+		{"@url", "https:// http:/example.com mailto:a@b.com", "  "},
+		{"@url", "xhttps://example.com file:///etc/passwd", "     "},
+		// uuid
+		{"@uuid", "id=123e4567-e89b-12d3-a456-426614174000;", " 123e4567-e89b-12d3-a456-426614174000"},
+		{"@uuid", "req-00000000-0000-0000-0000-000000000000", " 00000000-0000-0000-0000-000000000000"},
+		{"@uuid", "123E4567-E89B-12D3-A456-426614174000", "    123E4567-E89B-12D3-A456-426614174000"},
+		{"@uuid", "123e4567-e89b-12d3-a456-42661417400", "     "},
+		{"@uuid", "123e4567-e89b-12d3-a456-4266141740000", "   "},
+		{"@uuid", "123e4567e89b12d3a456426614174000", "        "},
+	} {
+		m, err := CompileWithOptions(tt.expr, Options{Builtins: true})
+		is.NoErr(err)
+		var tokens []string
+		for _, span := range FindAll(m, tt.str) {
+			tokens = append(tokens, tt.str[span.Start:span.End])
+		}
+		is.Eqf(strings.TrimSpace(tt.want), strings.Join(tokens, "|"), "%s in %q", tt.expr, tt.str)
+		is.Eqf(strings.TrimSpace(tt.want) != "", m.Match(tt.str), "%s matches %q", tt.expr, tt.str)
+	}
+}
+
+func TestBuiltinOptions(t *testing.T) {
+	is := internal.Assert(t)
+	opts := Options{Builtins: true}
+	m, err := CompileWithOptions("@uuid AND NOT @ipv4", opts)
+	is.NoErr(err)
+	is.Eq("@uuid AND NOT @ipv4", fmt.Sprint(m))
+	is.True(m.Match("id 123e4567-e89b-12d3-a456-426614174000"))
+	is.False(m.Match("id 123e4567-e89b-12d3-a456-426614174000 from 10.0.0.1"))
+	plan, err := ExplainWithOptions("ATLEAST 1 (@email, @url)", opts)
+	is.NoErr(err)
+	is.Eq("ATLEAST 1[@email,@url]", plan)
+	_, err = CompileWithOptions("@uuid(4)", opts)
+	is.Eq("syntax error at column 1: invalid call @uuid(4): too many arguments", fmt.Sprint(err))
+	m, err = CompileWithOptions("@ip( 10.0.0.0/8 , \"::1\") OR @ip(1.2.3.4-1.2.3.9)", opts)
+	is.NoErr(err)
+	is.Eq("@ip(10.0.0.0/8, ::1) OR @ip(1.2.3.4-1.2.3.9)", fmt.Sprint(m))
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"@ip", "                   invalid call @ip: missing arguments"},
+		{"@ip()", "                 invalid call @ip: missing arguments"},
+		{"@ip(10.0.0.0/33)", "      invalid call @ip(10.0.0.0/33): invalid prefix \"10.0.0.0/33\""},
+		{"@ip(10.0.0)", "           invalid call @ip(10.0.0): invalid address \"10.0.0\""},
+		{"@ip(10.0.0.9-10.0.0.1)", "invalid call @ip(10.0.0.9-10.0.0.1): invalid range \"10.0.0.9-10.0.0.1\""},
+		{"@ip(10.0.0.1-::1)", "     invalid call @ip(10.0.0.1-::1): invalid range \"10.0.0.1-::1\""},
+		{"@ip(fe80::1%eth0)", "     invalid call @ip(fe80::1%eth0): invalid address \"fe80::1%eth0\""},
+	} {
+		_, err = CompileWithOptions(tt.expr, opts)
+		is.Eqf("syntax error at column 1: "+strings.TrimSpace(tt.want), fmt.Sprint(err), "error for %q", tt.expr)
+	}
+	_, err = CompileWithOptions("@iban", opts)
+	is.Eq("syntax error at column 1: unknown function @iban", fmt.Sprint(err))
+	// Funcs override built-in functions
+	opts.Funcs = map[string]Func{"uuid": Predicate(func(str string) bool { return str == "uuid" })}
+	m, err = CompileWithOptions("@uuid", opts)
+	is.NoErr(err)
+	is.True(m.Match("uuid"))
+	is.False(m.Match("123e4567-e89b-12d3-a456-426614174000"))
+	// without Builtins, built-in functions are not available
+	_, err = CompileWithOptions("@uuid", Options{Funcs: map[string]Func{}})
+	is.Eq("syntax error at column 1: unknown function @uuid", fmt.Sprint(err))
+	is.True(MustCompile("@uuid").Match("@uuid"))
+	// the list is sorted and complete
+	var names []string
+	for _, b := range BuiltinFuncs() {
+		names = append(names, b.Name)
+		is.True(b.Doc != "")
+	}
+	is.True(slices.IsSorted(names))
+	is.Eq("email hexhash ip ipv4 ipv6 isodate url uuid", strings.Join(names, " "))
+}
+
+func TestBuiltinsLongLines(t *testing.T) {
+	is := internal.Assert(t)
+	// the lines are as long as bufio.Scanner allows, and full of
+	// candidates that are rejected, so they take quadratic time if a
+	// matcher retries inside rejected candidates
+	const size = 64 * 1024
+	for _, tt := range []struct {
+		expr string
+		unit string // repeated to fill the line
+	}{
+		{"@email", "a"},
+		{"@email", "a."},
+		{"@email", "a@a"},
+		{"@email", "a@a.-"},
+		{"@hexhash", "a"},
+		{"@hexhash", "0"},
+		{"@ipv4", "1.1.1.1."},
+		{"@ipv4", "1."},
+		{"@ipv6", ":"},
+		{"@ipv6", "a:"},
+		{"@ipv6", "a:1.1.1.1."},
+		{"@ip(10.0.0.0/8, ::1)", "a:"},
+		{"@ip(10.0.0.0/8, ::1)", "1.1.1.1."},
+		{"@ip(10.0.0.0/8, ::1)", "1.1.1.1 ::2 "},
+		{"@isodate", "2024-01-01-"},
+		{"@isodate", "2024-01-01T00:00:00."},
+		{"@url", "http:///"},
+		{"@url", "http://?"},
+		{"@uuid", "00000000-"},
+	} {
+		m, err := CompileWithOptions(tt.expr, Options{Builtins: true})
+		is.NoErr(err)
+		line := strings.Repeat(tt.unit, size/len(tt.unit))
+		is.Eqf(0, len(FindAll(m, line)), "%s in %q...", tt.expr, tt.unit)
+		is.Eqf(false, m.Match(line), "%s matches %q...", tt.expr, tt.unit)
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp/syntax"
+	"slices"
 	"strings"
+	"unicode"
 
 	"github.com/cvilsmeier/bmatch"
+	"github.com/cvilsmeier/bmatch/ast"
 )
 
 func usage() {
@@ -28,9 +32,24 @@ func usage() {
 	fmt.Println("    -explain")
 	fmt.Println("            Print expression tree and exit.")
 	fmt.Println("            Useful for hunting down shell escaping issues.")
+	fmt.Println("    -color")
+	fmt.Println("            Highlight the matching parts of each printed line.")
+	fmt.Println("    -i")
+	fmt.Println("            Ignore case when matching.")
+	fmt.Println("    -w")
+	fmt.Println("            Match string literals as whole words only.")
+	fmt.Println("    -glob")
+	fmt.Println("            Treat '*' and '?' in string literals as wildcards.")
+	fmt.Println("    -smart-case")
+	fmt.Println("            Ignore case if the literals of the expression")
+	fmt.Println("            contain no uppercase characters.")
+	fmt.Println("    -builtins")
+	fmt.Println("            Make literals like '@ipv4' call built-in functions.")
+	fmt.Println("            To match a literal '@' then, escape it ('\\@').")
+	fmt.Println("    -list-builtins")
+	fmt.Println("            Print the built-in functions and exit.")
 	fmt.Println("    -lower")
-	fmt.Println("            Convert all input lines to lowercase before matching.")
-	fmt.Println("            Useful for ignoring case.")
+	fmt.Println("            Deprecated: same as -i.")
 	fmt.Println("    -help")
 	fmt.Println("            Print this help page and exit")
 	fmt.Println("")
@@ -39,11 +58,30 @@ func usage() {
 
 func main() {
 	var explain bool
-	var lower bool
+	var color bool
+	var ignoreCase bool
+	var smartCase bool
+	var wholeWords bool
+	var glob bool
+	var builtins bool
+	var listBuiltins bool
 	flag.Usage = usage
 	flag.BoolVar(&explain, "explain", explain, "")
-	flag.BoolVar(&lower, "lower", lower, "")
+	flag.BoolVar(&color, "color", color, "")
+	flag.BoolVar(&ignoreCase, "i", ignoreCase, "")
+	flag.BoolVar(&smartCase, "smart-case", smartCase, "")
+	flag.BoolVar(&wholeWords, "w", wholeWords, "")
+	flag.BoolVar(&glob, "glob", glob, "")
+	flag.BoolVar(&builtins, "builtins", builtins, "")
+	flag.BoolVar(&listBuiltins, "list-builtins", listBuiltins, "")
+	flag.BoolVar(&ignoreCase, "lower", ignoreCase, "")
 	flag.Parse()
+	if listBuiltins {
+		for _, b := range bmatch.BuiltinFuncs() {
+			fmt.Printf("    @%-10s %s\n", b.Name, b.Doc)
+		}
+		return
+	}
 	if flag.NArg() == 0 {
 		fmt.Println("Usage: bmatch [flags] expr [file]...")
 		fmt.Println("Try 'bmatch -help' for more information.")
@@ -51,46 +89,95 @@ func main() {
 		return
 	}
 	expr := flag.Arg(0)
+	opts := bmatch.Options{IgnoreCase: ignoreCase, WholeWords: wholeWords, Glob: glob, Builtins: builtins}
 	if explain {
-		plan, err := bmatch.Explain(expr)
+		plan, err := bmatch.ExplainWithOptions(expr, opts)
 		if err != nil {
-			fmt.Printf("bmatch: %s\n", err)
+			printError(err)
 			os.Exit(1)
 			return
 		}
 		fmt.Printf("%s\n", plan)
 		return
 	}
-	matcher, err := bmatch.Compile(expr)
+	if smartCase && !ignoreCase {
+		opts.IgnoreCase = !hasUpper(expr, opts)
+	}
+	matcher, err := bmatch.CompileWithOptions(expr, opts)
 	if err != nil {
-		fmt.Printf("bmatch: %s\n", err)
+		printError(err)
 		os.Exit(1)
 		return
 	}
 	if flag.NArg() == 1 {
-		matchReader(os.Stdin, matcher, lower)
+		matchReader(os.Stdin, matcher, color)
 	}
 	for i := range flag.NArg() - 1 {
 		filename := flag.Arg(i + 1)
-		matchFile(filename, matcher, lower)
+		matchFile(filename, matcher, color)
 	}
 }
 
-func matchFile(filename string, matcher bmatch.Matcher, lower bool) {
+// hasUpper reports whether the literals of an expression contain
+// uppercase characters. Keywords and regex syntax like '\\S' do not count.
+func hasUpper(expr string, opts bmatch.Options) bool {
+	node, err := bmatch.ParseExprWithOptions(expr, opts)
+	if err != nil {
+		return false // Compile will report the error
+	}
+	upper := false
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.StringLit:
+			upper = upper || strings.IndexFunc(n.Value, unicode.IsUpper) >= 0
+		case *ast.GlobLit:
+			upper = upper || strings.IndexFunc(n.Pattern, unicode.IsUpper) >= 0
+		case *ast.RegexLit:
+			if re, err := syntax.Parse(n.Pattern, syntax.Perl); err == nil {
+				upper = upper || regexHasUpper(re)
+			}
+		}
+		return !upper
+	})
+	return upper
+}
+
+// regexHasUpper reports whether the literal characters of a regex
+// contain uppercase characters.
+func regexHasUpper(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral && slices.ContainsFunc(re.Rune, unicode.IsUpper) {
+		return true
+	}
+	return slices.ContainsFunc(re.Sub, regexHasUpper)
+}
+
+func printError(err error) {
+	fmt.Printf("bmatch: %s\n", err)
+	var serr *bmatch.SyntaxError
+	if errors.As(err, &serr) {
+		fmt.Printf("%s\n", serr.Caret())
+	}
+}
+
+func matchFile(filename string, matcher bmatch.Matcher, color bool) {
 	f, err := os.Open(filename)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		return
 	}
 	defer f.Close()
-	matchReader(f, matcher, lower)
+	matchReader(f, matcher, color)
 }
 
-func matchReader(r io.Reader, matcher bmatch.Matcher, lower bool) {
+func matchReader(r io.Reader, matcher bmatch.Matcher, color bool) {
 	sca := bufio.NewScanner(r)
 	for sca.Scan() {
 		line := sca.Text()
-		if matchLine(line, matcher, lower) {
+		if color {
+			if spans := bmatch.FindAll(matcher, line); spans != nil {
+				fmt.Println(colorize(line, spans))
+			}
+		} else if matcher.Match(line) {
 			fmt.Println(line)
 		}
 	}
@@ -102,9 +189,22 @@ func matchReader(r io.Reader, matcher bmatch.Matcher, lower bool) {
 	}
 }
 
-func matchLine(line string, matcher bmatch.Matcher, lower bool) bool {
-	if lower {
-		line = strings.ToLower(line)
+const (
+	colorOn  = "\x1b[1;31m"
+	colorOff = "\x1b[0m"
+)
+
+// colorize highlights spans in line with ANSI escape codes.
+func colorize(line string, spans []bmatch.Span) string {
+	var sb strings.Builder
+	offset := 0
+	for _, span := range spans {
+		sb.WriteString(line[offset:span.Start])
+		sb.WriteString(colorOn)
+		sb.WriteString(line[span.Start:span.End])
+		sb.WriteString(colorOff)
+		offset = span.End
 	}
-	return matcher.Match(line)
+	sb.WriteString(line[offset:])
+	return sb.String()
 }
@@ -1,8 +1,10 @@
 package bmatch_test
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
 
 	"github.com/cvilsmeier/bmatch"
 )
@@ -33,3 +35,39 @@ func ExampleExplain() {
 	fmt.Println(plan)
 	// Output: OR[/foo/,AND[/bar/,NOT[/bill/]]]
 }
+
+func ExampleFindAll() {
+	matcher := bmatch.MustCompile("foo OR /ba+r/")
+	str := "foo or baaar"
+	for _, span := range bmatch.FindAll(matcher, str) {
+		fmt.Println(str[span.Start:span.End])
+	}
+	// Output:
+	// foo
+	// baaar
+}
+
+func ExampleSyntaxError() {
+	_, err := bmatch.Compile("foo AND (bar OR)")
+	var serr *bmatch.SyntaxError
+	if errors.As(err, &serr) {
+		fmt.Println(serr)
+		fmt.Println(serr.Caret())
+	}
+	// Output:
+	// syntax error at column 16: unexpected ")", expected literal, "(", "NOT", "ATLEAST", "EXACTLY" or "ATMOST"
+	// foo AND (bar OR)
+	//                ^
+}
+
+func ExampleAnd() {
+	matcher := bmatch.And(
+		bmatch.Literal("user 42"),
+		bmatch.Or(bmatch.Literal("error"), bmatch.Regex(regexp.MustCompile("5[0-9]{2}"))),
+	)
+	fmt.Println(matcher)
+	fmt.Println(matcher.Match("user 42: status 503"))
+	// Output:
+	// "user 42" AND (error OR /5[0-9]{2}/)
+	// true
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A SyntaxError describes a malformed expression.
+type SyntaxError struct {
+	Pos      int      // byte offset of the offending input
+	End      int      // byte offset after the offending input
+	Msg      string   // description of the error
+	Expected []string // what would have been valid at Pos, may be empty
+}
+
+func (e *SyntaxError) Error() string {
+	if len(e.Expected) == 0 {
+		return e.Msg
+	}
+	return e.Msg + ", expected " + DescribeExpected(e.Expected)
+}
+
+// DescribeExpected formats a list of expected tokens for error messages,
+// e.g. `"AND", "OR" or end of expression`.
+func DescribeExpected(expected []string) string {
+	var sb strings.Builder
+	for i, s := range expected {
+		if i > 0 {
+			if i == len(expected)-1 {
+				sb.WriteString(" or ")
+			} else {
+				sb.WriteString(", ")
+			}
+		}
+		// token classes like 'literal' are lowercase, keywords and symbols are quoted
+		if r, _ := utf8.DecodeRuneInString(s); unicode.IsLower(r) {
+			sb.WriteString(s)
+		} else {
+			sb.WriteString(strconv.Quote(s))
+		}
+	}
+	return sb.String()
+}
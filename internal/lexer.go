@@ -2,6 +2,10 @@ package internal
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // A Lexer yields tokens, one after another.
@@ -11,13 +15,27 @@ type Lexer interface {
 }
 
 type Token struct {
-	Typ  TokenTyp
-	Text string
+	Typ   TokenTyp
+	Text  string
+	Pos   int      // byte offset of the first character in the input
+	End   int      // byte offset after the last character in the input
+	Flags string   // literal modifiers, e.g. "i" for case-insensitive
+	Count string   // occurrence count of a literal without braces, e.g. "2,5"
+	Args  []string // arguments of a function call
 }
 
 func (t Token) IsZero() bool { return int(t.Typ) == 0 }
 func (t Token) IsEOF() bool  { return t.Typ == EOFToken }
 
+// startsOperand reports whether the token can be the first token of an operand.
+func (t Token) startsOperand() bool {
+	switch t.Typ {
+	case StringToken, RegexToken, RefToken, FuncToken, OpenToken, NotToken, ThresholdToken:
+		return true
+	}
+	return false
+}
+
 type TokenTyp int
 
 const (
@@ -27,128 +45,781 @@ const (
 	NotToken
 	AndToken
 	OrToken
+	XorToken
+	ImpliesToken
 	StringToken
 	RegexToken
+	RefToken    // '$name', Text is the name
+	FuncToken   // '@name' or '@name(args)', Text is the name
+	NearToken   // NEAR/n
+	BeforeToken // BEFORE/n
+	ThenToken
+	ThresholdToken // ATLEAST k, EXACTLY k or ATMOST k
+	CommaToken     // separates the operands of ATLEAST k (...)
 	EOFToken
 )
 
 // A StringLexer tokenizes an input string.
 type StringLexer struct {
 	tokens []Token
+	end    int
+}
+
+// LexOptions control tokenizing.
+type LexOptions struct {
+	// Extended enables alternative operator spellings: "!", "&&", "||",
+	// lowercase "not", "and", "or", and "+" and "-" prefixes. "&&" and
+	// "||" are operators even inside unquoted string literals.
+	Extended bool
+
+	// Glob makes string literals with unescaped '*' or '?' wildcards
+	// glob patterns, as if they had a 'glob:' prefix. Quoted strings and
+	// whole-word literals are never glob patterns.
+	Glob bool
+
+	// Refs makes unescaped literals like '$name' references to named
+	// definitions. Otherwise, they are plain string literals.
+	Refs bool
+
+	// Funcs makes unescaped literals like '@name' and '@name(args)'
+	// function calls. Otherwise, they are plain string literals.
+	Funcs bool
+
+	// Bind, if not nil, makes unescaped '?' characters in unquoted string
+	// literals placeholders. Each placeholder is replaced by Bind(i), where
+	// i counts the placeholders from zero. The bytes of the value are
+	// literal, as if they were escaped, even if they are not valid UTF-8,
+	// so that a value never changes the structure of the expression.
+	Bind func(i int) string
 }
 
 func NewStringLexer(input string) (*StringLexer, error) {
+	return NewStringLexerWithOptions(input, LexOptions{})
+}
+
+// NewStringLexerWithOptions is like NewStringLexer but with options.
+func NewStringLexerWithOptions(input string, opts LexOptions) (*StringLexer, error) {
 	var stack rstack
 	var tokens []Token
-	consumeStack := func() {
+	var start int         // start offset of the current string or regex token
+	var fold bool         // the current string token is case-insensitive ('~')
+	var word bool         // the current string token is a whole word ('word:')
+	var glob bool         // the current string token is a glob pattern ('glob:')
+	var anchorStart bool  // the current string token is anchored at the start ('^')
+	var anchorEnd bool    // the current string token ends with an unescaped '$'
+	var escaped bool      // the current string token contains escape sequences
+	var afterRegex bool   // the current string token directly follows a regex
+	var afterQuote bool   // the current character directly follows a quoted string
+	var distanceOp string // the operator of the current 'NEAR/n' or 'BEFORE/n' token
+	var parens []bool     // open parentheses, true for operand lists of 'ATLEAST k'
+	var lists int         // number of open operand lists, in which ',' is a token
+	var count string      // the occurrence count of the current string token ('{n,m}')
+	var skip int          // number of bytes to skip, already consumed by a lookahead
+	var params int        // number of placeholders so far
+	var param bool        // the current string token contains a placeholder ('?')
+	literalFlags := func() string {
+		var flags string
+		if fold {
+			flags += "i"
+		}
+		if word {
+			flags += "w"
+		}
+		if glob {
+			flags += "g"
+		}
+		if anchorStart {
+			flags += "^"
+		}
+		if anchorEnd {
+			flags += "$"
+		}
+		return flags
+	}
+	// bind pushes the value of the next placeholder.
+	bind := func() {
+		// the bytes of the value, even if it is not valid UTF-8
+		stack.pushEscaped(opts.Bind(params))
+		params++
+		escaped, param, anchorEnd = true, true, false
+	}
+	consumeStack := func(end int) error {
+		pattern, wild := stack.glob()
 		text := stack.pop()
+		if distanceOp != "" {
+			defer func() { distanceOp = "" }()
+			if _, err := strconv.Atoi(text); err != nil || strings.Trim(text, "0123456789") != "" {
+				return &SyntaxError{start, end, fmt.Sprintf("invalid distance %q", input[start:end]), nil}
+			}
+			typ := NearToken
+			if strings.EqualFold(distanceOp, "BEFORE") {
+				typ = BeforeToken
+			}
+			tokens = append(tokens, Token{Typ: typ, Text: input[start:end], Pos: start, End: end})
+			return nil
+		}
+		defer func() {
+			fold, word, glob, escaped, afterRegex = false, false, false, false, false
+			anchorStart, anchorEnd, count, param = false, false, "", false
+		}()
+		if n := len(tokens); n > 0 && tokens[n-1].Typ == ThresholdToken && !hasCount(tokens[n-1]) {
+			// the count of 'ATLEAST k', 'EXACTLY k' or 'ATMOST k'
+			if _, err := strconv.Atoi(text); err != nil || escaped || literalFlags() != "" || count != "" || strings.Trim(text, "0123456789") != "" {
+				return &SyntaxError{start, end, fmt.Sprintf("invalid count %q", input[start:end]), nil}
+			}
+			tokens[n-1].Text += " " + text
+			tokens[n-1].End = end
+			return nil
+		}
+		if afterRegex && !escaped && !word && !glob && !anchorStart && isRegexFlags(text) {
+			tokens[len(tokens)-1].Flags = text
+			tokens[len(tokens)-1].Count = count
+			tokens[len(tokens)-1].End = end
+			return nil
+		}
+		if opts.Glob && wild && !word {
+			glob = true
+		}
+		if glob {
+			text = pattern
+		}
+		if anchorEnd && (len(text) > 1 || anchorStart || param) {
+			text = text[:len(text)-1]
+		} else {
+			// a lone '$' is a plain literal
+			anchorEnd = false
+		}
+		if param && text == "" && !(anchorStart && anchorEnd) {
+			// the empty literal would match everything
+			return &SyntaxError{start, end, "empty value for placeholder", nil}
+		}
+		if fold || word || glob || anchorStart || anchorEnd || count != "" {
+			if text == "" && !(anchorStart && anchorEnd) && !param {
+				switch lone := input[start:end]; lone {
+				case "~", "^", "word:", "glob:":
+					// a lone modifier is a plain literal, like a lone '$'
+					tokens = append(tokens, Token{Typ: StringToken, Text: lone, Pos: start, End: end})
+					return nil
+				}
+				return &SyntaxError{start, end, fmt.Sprintf("missing literal after '%s'", input[start:end]), nil}
+			}
+			if opts.Refs && !escaped && strings.HasPrefix(text, "$") && IsName(text[1:]) {
+				return &SyntaxError{start, end, fmt.Sprintf("invalid modifier for reference %q", input[start:end]), nil}
+			}
+			if opts.Funcs && !escaped && isCall(text) {
+				return &SyntaxError{start, end, fmt.Sprintf("invalid modifier for function call %q", input[start:end]), nil}
+			}
+			tokens = append(tokens, Token{Typ: StringToken, Text: text, Pos: start, End: end, Flags: literalFlags(), Count: count})
+			return nil
+		}
+		if param {
+			// a bound value is a literal, even if it looks like a keyword
+			tokens = append(tokens, Token{Typ: StringToken, Text: text, Pos: start, End: end})
+			return nil
+		}
+		if opts.Refs && !escaped && strings.HasPrefix(text, "$") && IsName(text[1:]) {
+			tokens = append(tokens, Token{Typ: RefToken, Text: text[1:], Pos: start, End: end})
+			return nil
+		}
+		if opts.Funcs && !escaped && isCall(text) {
+			tokens = append(tokens, Token{Typ: FuncToken, Text: text[1:], Pos: start, End: end})
+			return nil
+		}
+		if opts.Extended {
+			switch text {
+			case "not":
+				tokens = append(tokens, Token{Typ: NotToken, Text: text, Pos: start, End: end})
+				return nil
+			case "and":
+				tokens = append(tokens, Token{Typ: AndToken, Text: text, Pos: start, End: end})
+				return nil
+			case "or":
+				tokens = append(tokens, Token{Typ: OrToken, Text: text, Pos: start, End: end})
+				return nil
+			case "then":
+				tokens = append(tokens, Token{Typ: ThenToken, Text: text, Pos: start, End: end})
+				return nil
+			case "xor":
+				tokens = append(tokens, Token{Typ: XorToken, Text: text, Pos: start, End: end})
+				return nil
+			case "implies":
+				tokens = append(tokens, Token{Typ: ImpliesToken, Text: text, Pos: start, End: end})
+				return nil
+			case "atleast", "exactly", "atmost":
+				tokens = append(tokens, Token{Typ: ThresholdToken, Text: text, Pos: start, End: end})
+				return nil
+			}
+		}
 		switch text {
 		case "":
 			// ignore
 		case "NOT":
-			tokens = append(tokens, Token{NotToken, ""})
+			tokens = append(tokens, Token{Typ: NotToken, Text: text, Pos: start, End: end})
 		case "AND":
-			tokens = append(tokens, Token{AndToken, ""})
+			tokens = append(tokens, Token{Typ: AndToken, Text: text, Pos: start, End: end})
 		case "OR":
-			tokens = append(tokens, Token{OrToken, ""})
+			tokens = append(tokens, Token{Typ: OrToken, Text: text, Pos: start, End: end})
+		case "XOR":
+			tokens = append(tokens, Token{Typ: XorToken, Text: text, Pos: start, End: end})
+		case "IMPLIES":
+			tokens = append(tokens, Token{Typ: ImpliesToken, Text: text, Pos: start, End: end})
+		case "THEN":
+			tokens = append(tokens, Token{Typ: ThenToken, Text: text, Pos: start, End: end})
+		case "ATLEAST", "EXACTLY", "ATMOST":
+			tokens = append(tokens, Token{Typ: ThresholdToken, Text: text, Pos: start, End: end})
 		default:
-			tokens = append(tokens, Token{StringToken, text})
+			tokens = append(tokens, Token{Typ: StringToken, Text: text, Pos: start, End: end})
+		}
+		return nil
+	}
+	openParen := func(i int) {
+		n := len(tokens)
+		list := n > 0 && tokens[n-1].Typ == ThresholdToken && hasCount(tokens[n-1])
+		if list {
+			lists++
+		}
+		parens = append(parens, list)
+		tokens = append(tokens, Token{Typ: OpenToken, Text: "(", Pos: i, End: i + 1})
+	}
+	closeParen := func(i int) {
+		if n := len(parens); n > 0 {
+			if parens[n-1] {
+				lists--
+			}
+			parens = parens[:n-1]
 		}
+		tokens = append(tokens, Token{Typ: CloseToken, Text: ")", Pos: i, End: i + 1})
+	}
+	// countAt returns the occurrence count suffix at input[i:], like '{2}'
+	// or '{2,5}', without braces, and its length. The suffix must end the
+	// literal, otherwise the length is zero.
+	countAt := func(i int) (string, int, error) {
+		n := countSuffixLen(input[i:])
+		if n == 0 || i+n < len(input) && !strings.ContainsRune(" ()/", rune(input[i+n])) && (input[i+n] != ',' || lists == 0) && !(opts.Extended && isSymbolOperator(input[i+n:])) {
+			return "", 0, nil
+		}
+		text := input[i+1 : i+n-1]
+		if _, _, err := ParseCount(text); err != nil {
+			return "", 0, &SyntaxError{i, i + n, fmt.Sprintf("invalid count %q", input[i:i+n]), nil}
+		}
+		return text, n, nil
+	}
+	// argsAt returns the arguments of the function call at input[i:], which
+	// starts with '(', and the length of the argument list. Arguments are
+	// separated by commas. They are either quoted strings, or unquoted
+	// strings without '"', '(', ')' and ',', and without surrounding spaces.
+	argsAt := func(i int) ([]string, int, error) {
+		var args []string
+		j := i + 1
+		for {
+			for j < len(input) && input[j] == ' ' {
+				j++
+			}
+			if j < len(input) && input[j] == ')' && len(args) == 0 {
+				return nil, j + 1 - i, nil
+			}
+			if j < len(input) && input[j] == '"' {
+				quoted, err := strconv.QuotedPrefix(input[j:])
+				if err != nil {
+					return nil, 0, &SyntaxError{j, len(input), fmt.Sprintf("unclosed quoted string %s", input[j:]), nil}
+				}
+				arg, err := strconv.Unquote(quoted)
+				if err != nil {
+					return nil, 0, &SyntaxError{j, j + len(quoted), fmt.Sprintf("invalid quoted string %s", quoted), nil}
+				}
+				args = append(args, arg)
+				j += len(quoted)
+			} else {
+				n := strings.IndexAny(input[j:], "\"(),")
+				if n < 0 {
+					break
+				}
+				arg := strings.TrimRight(input[j:j+n], " ")
+				if arg == "" {
+					return nil, 0, &SyntaxError{j, j, "missing argument", nil}
+				}
+				args = append(args, arg)
+				j += n
+			}
+			for j < len(input) && input[j] == ' ' {
+				j++
+			}
+			if j == len(input) {
+				break
+			}
+			switch input[j] {
+			case ',':
+				j++
+			case ')':
+				return args, j + 1 - i, nil
+			default:
+				return nil, 0, &SyntaxError{j, j + 1, fmt.Sprintf("unexpected %q in argument list", input[j:j+1]), nil}
+			}
+		}
+		return nil, 0, &SyntaxError{i, len(input), "unclosed argument list", nil}
 	}
 	var inEscape bool
 	var inRegex bool
 	var inString bool
-	for _, r := range input {
-		if inEscape {
-			switch r {
-			case ' ', '(', ')', '/', '\\':
-				stack.push(r)
-				inEscape = false
-			default:
-				return nil, fmt.Errorf("invalid escape sequence in %q", stack.pop())
+	var inQuote bool
+	var quoteStart int // start offset of the current quoted string
+	var quoteEscape bool
+	for i, r := range input {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if afterQuote {
+			afterQuote = false
+			if r == '$' {
+				tokens[len(tokens)-1].Flags += "$"
+				tokens[len(tokens)-1].End = i + 1
+				continue
+			}
+		}
+		if inQuote {
+			switch {
+			case quoteEscape:
+				quoteEscape = false
+			case r == '\\':
+				quoteEscape = true
+			case r == '"':
+				inQuote = false
+				quoted := input[quoteStart : i+1]
+				text, err := strconv.Unquote(quoted)
+				if err != nil {
+					return nil, &SyntaxError{quoteStart, i + 1, fmt.Sprintf("invalid quoted string %s", quoted), nil}
+				}
+				tokens = append(tokens, Token{Typ: StringToken, Text: text, Pos: start, End: i + 1, Flags: literalFlags(), Count: count})
+				fold, word, glob, anchorStart, count = false, false, false, false, ""
+				afterQuote = true
+			}
+		} else if inEscape {
+			if !isEscapable(r, inRegex) {
+				return nil, &SyntaxError{i - 1, i + utf8.RuneLen(r), fmt.Sprintf("invalid escape sequence %q", input[i-1:i+utf8.RuneLen(r)]), nil}
 			}
+			stack.pushEscaped(string(r))
+			anchorEnd = false
+			inEscape = false
+			inString = !inRegex
 		} else if inRegex {
 			switch r {
 			case '/':
 				inRegex = false
-				tokens = append(tokens, Token{RegexToken, stack.pop()})
+				tokens = append(tokens, Token{Typ: RegexToken, Text: stack.pop(), Pos: start, End: i + 1})
+				afterRegex = true
 			case '\\':
 				inEscape = true
 			default:
 				stack.push(r)
 			}
+		} else if opts.Extended && isSymbolOperator(input[i:]) {
+			// '&&' and '||' need no spaces around them, like in 'a&&(b||c)'
+			if inString {
+				inString = false
+				if err := consumeStack(i); err != nil {
+					return nil, err
+				}
+			}
+			typ := AndToken
+			if r == '|' {
+				typ = OrToken
+			}
+			tokens = append(tokens, Token{Typ: typ, Text: input[i : i+2], Pos: i, End: i + 2})
+			afterRegex = false
+			skip = 1
+		} else if inString && distanceOp != "" && r != ' ' && r != '(' && r != ')' && (r != ',' || lists == 0) {
+			// the distance of 'NEAR/n' or 'BEFORE/n'
+			stack.push(r)
 		} else if inString {
+			var err error
 			switch r {
 			case ' ':
 				inString = false
-				consumeStack()
+				err = consumeStack(i)
 			case '(':
 				inString = false
-				consumeStack()
-				tokens = append(tokens, Token{OpenToken, ""})
+				if opts.Funcs && !escaped && literalFlags() == "" && count == "" && isCall(stack.String()) {
+					// '@name(args)'
+					var args []string
+					var n int
+					if args, n, err = argsAt(i); err == nil {
+						tokens = append(tokens, Token{Typ: FuncToken, Text: stack.pop()[1:], Pos: start, End: i + n, Args: args})
+						afterRegex = false
+						skip = n - 1
+					}
+					break
+				}
+				if err = consumeStack(i); err == nil {
+					openParen(i)
+				}
 			case ')':
 				inString = false
-				consumeStack()
-				tokens = append(tokens, Token{CloseToken, ""})
+				err = consumeStack(i)
+				closeParen(i)
+			case ',':
+				if lists == 0 {
+					stack.push(r)
+					anchorEnd = false
+					break
+				}
+				inString = false
+				err = consumeStack(i)
+				tokens = append(tokens, Token{Typ: CommaToken, Text: ",", Pos: i, End: i + 1})
 			case '/':
+				if !escaped && literalFlags() == "" && isDistanceOperator(stack.String(), opts.Extended) {
+					distanceOp = stack.pop()
+					break
+				}
 				inString = false
-				consumeStack()
+				err = consumeStack(i)
+				start = i
 				inRegex = true
 			case '\\':
 				inEscape = true
+				escaped = true
+			case ':':
+				if !word && !glob && !anchorStart && !escaped && stack.len() == 4 && stack.String() == "word" {
+					// 'word:' prefix
+					stack.pop()
+					word = true
+				} else if !word && !glob && !anchorStart && !escaped && stack.len() == 4 && stack.String() == "glob" {
+					// 'glob:' prefix
+					stack.pop()
+					glob = true
+				} else {
+					stack.push(r)
+					anchorEnd = false
+				}
+			case '{':
+				var n int
+				if count, n, err = countAt(i); n > 0 {
+					// '{n}', '{n,}' or '{n,m}' suffix
+					skip = n - 1
+					break
+				}
+				stack.push(r)
+				anchorEnd = false
+			case '^':
+				if !anchorStart && stack.len() == 0 {
+					// '^' after '~' or 'word:'
+					anchorStart = true
+				} else {
+					stack.push(r)
+					anchorEnd = false
+				}
+			case '"':
+				if stack.len() == 0 {
+					// quoted string after '~', 'word:', 'glob:' or '^'
+					inString = false
+					inQuote = true
+					quoteStart = i
+				} else {
+					stack.push(r)
+					anchorEnd = false
+				}
+			case '?':
+				if opts.Bind != nil {
+					bind()
+					break
+				}
+				stack.push(r)
+				anchorEnd = false
 			default:
 				stack.push(r)
+				anchorEnd = r == '$'
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else if opts.Extended && isPrefixOperator(input, i) {
+			// '+' marks required operands, which is the default anyway
+			if r != '+' {
+				tokens = append(tokens, Token{Typ: NotToken, Text: string(r), Pos: i, End: i + 1})
+			}
+			afterRegex = false
+		} else if r == '{' && countSuffixLen(input[i:]) > 0 && isLiteral(tokens, i) {
+			// count suffix of a quoted string or a regex
+			c, n, err := countAt(i)
+			if err != nil {
+				return nil, err
 			}
+			if n == 0 {
+				return nil, &SyntaxError{i, i + countSuffixLen(input[i:]), "count must end the literal", nil}
+			}
+			tokens[len(tokens)-1].Count = c
+			tokens[len(tokens)-1].End = i + n
+			skip = n - 1
+			afterRegex = false
+		} else if r == ',' && lists > 0 {
+			tokens = append(tokens, Token{Typ: CommaToken, Text: ",", Pos: i, End: i + 1})
+			afterRegex = false
 		} else {
 			switch r {
 			case ' ':
 				// separator
+				afterRegex = false
 			case '(':
-				tokens = append(tokens, Token{OpenToken, ""})
+				openParen(i)
+				afterRegex = false
 			case ')':
-				tokens = append(tokens, Token{CloseToken, ""})
+				closeParen(i)
+				afterRegex = false
 			case '/':
+				start = i
 				inRegex = true
+				afterRegex = false
 			case '\\':
+				start = i
 				inEscape = true
+				escaped = true
+			case '~':
+				start = i
+				inString = true
+				fold = true
+				afterRegex = false
+			case '^':
+				start = i
+				inString = true
+				anchorStart = true
+				afterRegex = false
+			case '"':
+				start = i
+				inQuote = true
+				quoteStart = i
+				afterRegex = false
+			case '?':
+				start = i
+				inString = true
+				if opts.Bind != nil {
+					bind()
+					break
+				}
+				stack.push(r)
 			default:
+				start = i
 				stack.push(r)
+				anchorEnd = r == '$'
 				inString = true
 			}
 		}
 	}
 	if inEscape {
-		return nil, fmt.Errorf("unclosed escape sequence in %q", stack.pop())
+		return nil, &SyntaxError{len(input) - 1, len(input), "unclosed escape sequence", nil}
 	}
 	if inRegex {
-		return nil, fmt.Errorf("unclosed regex in %q", stack.pop())
+		return nil, &SyntaxError{start, len(input), fmt.Sprintf("unclosed regex %q", input[start:]), nil}
+	}
+	if inQuote {
+		return nil, &SyntaxError{quoteStart, len(input), fmt.Sprintf("unclosed quoted string %s", input[quoteStart:]), nil}
 	}
 	if inString {
-		consumeStack()
+		if err := consumeStack(len(input)); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range tokens {
+		if t.Typ == ThresholdToken && !hasCount(t) {
+			return nil, &SyntaxError{t.Pos, t.End, fmt.Sprintf("missing count after '%s'", t.Text), nil}
+		}
+	}
+	return &StringLexer{tokens, len(input)}, nil
+}
+
+// IsName reports whether s is a valid definition name: a letter or
+// underscore, followed by letters, digits and underscores.
+func IsName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCall reports whether text is a function call like '@name'.
+func isCall(text string) bool {
+	return strings.HasPrefix(text, "@") && IsName(text[1:])
+}
+
+// isLiteral reports whether the last token is a string or regex literal
+// without count that ends at offset end.
+func isLiteral(tokens []Token, end int) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	t := tokens[len(tokens)-1]
+	return (t.Typ == StringToken || t.Typ == RegexToken) && t.End == end && t.Count == ""
+}
+
+// countSuffixLen returns the length of the '{n}', '{n,}' or '{n,m}'
+// suffix at the start of s, or zero if there is none.
+func countSuffixLen(s string) int {
+	if !strings.HasPrefix(s, "{") {
+		return 0
+	}
+	end := strings.IndexByte(s, '}')
+	if end < 2 {
+		return 0
+	}
+	lo, hi, _ := strings.Cut(s[1:end], ",")
+	if lo == "" || strings.Trim(lo, "0123456789") != "" || strings.Trim(hi, "0123456789") != "" {
+		return 0
+	}
+	return end + 1
+}
+
+// ParseCount parses an occurrence count without braces, like "2", "2,"
+// or "2,5", into its bounds. The maximum is -1 if there is none.
+func ParseCount(text string) (int, int, error) {
+	lo, hi, comma := strings.Cut(text, ",")
+	min, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !comma {
+		return min, min, nil
 	}
-	return &StringLexer{tokens}, nil
+	if hi == "" {
+		return min, -1, nil
+	}
+	max, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("maximum %d is less than minimum %d", max, min)
+	}
+	return min, max, nil
+}
+
+// hasCount reports whether a ThresholdToken has its count already.
+func hasCount(t Token) bool {
+	return strings.Contains(t.Text, " ")
+}
+
+// isDistanceOperator reports whether text, followed by a slash, starts
+// a 'NEAR/n' or 'BEFORE/n' token.
+func isDistanceOperator(text string, extended bool) bool {
+	switch text {
+	case "NEAR", "BEFORE":
+		return true
+	case "near", "before":
+		return extended
+	}
+	return false
+}
+
+// isSymbolOperator reports whether input starts with '&&' or '||', which
+// are operators of the extended dialect even without spaces around them.
+func isSymbolOperator(input string) bool {
+	return strings.HasPrefix(input, "&&") || strings.HasPrefix(input, "||")
+}
+
+// isPrefixOperator reports whether the character at input[i] is a prefix
+// operator of the extended dialect: '!' always, '+' and '-' only if an
+// operand follows directly.
+func isPrefixOperator(input string, i int) bool {
+	switch input[i] {
+	case '!':
+		return true
+	case '+', '-':
+		return i+1 < len(input) && input[i+1] != ' ' && input[i+1] != ')'
+	}
+	return false
+}
+
+// isEscapable reports whether r may follow a backslash. The anchors '^'
+// and '$', the wildcards '*' and '?', the prefix operators '!', '+' and
+// '-', and '{' and '@' can be escaped in strings only, because in a regex,
+// they would otherwise silently lose their escaping.
+func isEscapable(r rune, inRegex bool) bool {
+	switch r {
+	case ' ', '(', ')', '/', '\\', '~', '"', ':', ',':
+		return true
+	case '^', '$', '*', '?', '{', '@', '!', '+', '-':
+		return !inRegex
+	}
+	return false
+}
+
+// isRegexFlags reports whether text is a list of regex flags.
+func isRegexFlags(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, r := range text {
+		switch r {
+		case 'i', 'm', 's', 'U':
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 func (l *StringLexer) NextToken() (Token, error) {
 	if len(l.tokens) == 0 {
-		return Token{EOFToken, ""}, nil
+		return Token{Typ: EOFToken, Pos: l.end, End: l.end}, nil
 	}
 	t := l.tokens[0]
 	l.tokens = l.tokens[1:]
 	return t, nil
 }
 
-// rstack is a stack of runes.
+// rstack is a stack of the bytes of runes, and of values that are pushed
+// as they are, even if they are not valid UTF-8.
 type rstack struct {
-	b []rune
+	b   []byte
+	esc []bool // whether b[i] was escaped
 }
 
 func (b *rstack) push(r rune) {
-	b.b = append(b.b, r)
+	n := len(b.b)
+	b.b = utf8.AppendRune(b.b, r)
+	b.esc = append(b.esc, make([]bool, len(b.b)-n)...)
+}
+
+// pushEscaped pushes the bytes of str as escaped characters.
+func (b *rstack) pushEscaped(str string) {
+	b.b = append(b.b, str...)
+	for range len(str) {
+		b.esc = append(b.esc, true)
+	}
+}
+
+// glob returns the stack as a glob pattern, in which escaped wildcards
+// and backslashes are escaped, and whether it contains unescaped wildcards.
+// Wildcards and backslashes are ASCII, so they are never part of the
+// encoding of another rune.
+func (b *rstack) glob() (string, bool) {
+	var sb strings.Builder
+	wild := false
+	for i, c := range b.b {
+		switch {
+		case b.esc[i] && (c == '*' || c == '?' || c == '\\'):
+			sb.WriteByte('\\')
+		case !b.esc[i] && (c == '*' || c == '?'):
+			wild = true
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), wild
+}
+
+func (b *rstack) len() int {
+	return len(b.b)
+}
+
+func (b *rstack) String() string {
+	return string(b.b)
 }
 
 func (b *rstack) pop() string {
 	text := string(b.b)
-	b.b = nil
+	b.b, b.esc = nil, nil
 	return text
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -35,13 +36,16 @@ func TestStringLexer(t *testing.T) {
 		{"string_20", "a \\ b c", "           'a', ' b', 'c'"},
 		{"string_25", "a b\\ b c", "          'a', 'b b', 'c'"},
 		{"string_30", "(\\/a\\/)\\(b\\)", "   (, '/a/', ), '(b)'"},
+		{"string_35", "\\  a", "                 ' ', 'a'"},
+		{"string_40", "a\\x", "                 err: invalid escape sequence \"\\\\x\""},
+		{"string_41", "a\\", "                  err: unclosed escape sequence"},
 		// regex literals
 		{"regex_01", "//", "                        r[]"},
 		{"regex_02", "////", "                      r[], r[]"},
 		{"regex_03", "// //", "                     r[], r[]"},
 		{"regex_11", "/a/", "                       r[a]"},
 		{"regex_11", "/a b c/", "                   r[a b c]"},
-		{"regex_12", "/a\\/", "                     err: unclosed regex in \"a/\""},
+		{"regex_12", "/a\\/", "                     err: unclosed regex \"/a\\\\/\""},
 		{"regex_13", "/a\\//", "                    r[a/]"},
 		{"regex_21", "/aa/", "                      r[aa]"},
 		{"regex_22", "/a a/", "                     r[a a]"},
@@ -54,6 +58,118 @@ func TestStringLexer(t *testing.T) {
 		{"regex_34", "(/a/)(/b/)", "                (, r[a], ), (, r[b], )"},
 		{"regex_35", "  (  /a/)(   /b/   ) ", "     (, r[a], ), (, r[b], )"},
 		{"regex_36", " ( /\\/a\\//)( /(b)/ ) ", "   (, r[/a/], ), (, r[(b)], )"},
+		{"regex_37", "/1\\+1/", "                   err: invalid escape sequence \"\\\\+\""},
+		{"regex_38", "/[a\\-c]/", "                 err: invalid escape sequence \"\\\\-\""},
+		{"regex_39", "/a\\!/", "                    err: invalid escape sequence \"\\\\!\""},
+		// regex flags
+		{"flags_01", "/a/i", "                      r[a]i"},
+		{"flags_02", "/a/imsU", "                   r[a]imsU"},
+		{"flags_03", "/a/i /b/s", "                 r[a]i, r[b]s"},
+		{"flags_04", "(/a/i)", "                    (, r[a]i, )"},
+		{"flags_05", "/a/i/b/", "                   r[a]i, r[b]"},
+		{"flags_06", "/a/ix", "                     r[a], 'ix'"},
+		{"flags_07", "/a/ i", "                     r[a], 'i'"},
+		{"flags_08", "/a/\\ i", "                  r[a], ' i'"},
+		{"flags_09", "/a/AND/b/", "                 r[a], AND, r[b]"},
+		// case-insensitive strings
+		{"fold_01", "~a", "                        'a'i"},
+		{"fold_02", "~a ~b", "                     'a'i, 'b'i"},
+		{"fold_03", "(~a)", "                      (, 'a'i, )"},
+		{"fold_04", "~a\\ b", "                    'a b'i"},
+		{"fold_05", "~AND", "                      'AND'i"},
+		{"fold_06", "a~b", "                       'a~b'"},
+		{"fold_07", "\\~a", "                      '~a'"},
+		{"fold_08", "~~a", "                       '~a'i"},
+		{"fold_09", "~", "                         '~'"},
+		{"fold_10", "~ a", "                       '~', 'a'"},
+		{"fold_11", "~/a/", "                      '~', r[a]"},
+		{"word_01", "word:a", "                    'a'w"},
+		{"word_02", "~word:a", "                   'a'iw"},
+		{"word_03", "word:\"a b\"", "                'a b'w"},
+		{"word_04", "word:word:a", "               'word:a'w"},
+		{"word_05", "word\\:a", "                  'word:a'"},
+		{"word_06", "words:a a:b", "               'words:a', 'a:b'"},
+		{"word_07", "/a/word:i", "                 r[a], 'i'w"},
+		{"word_08", "word:", "                     'word:'"},
+		{"word_09", "~word:(a)", "                 err: missing literal after '~word:'"},
+		{"anchor_01", "^a", "                    'a'^"},
+		{"anchor_02", "a$", "                    'a'$"},
+		{"anchor_03", "^a$ b", "                 'a'^$, 'b'"},
+		{"anchor_04", "^$", "                    ''^$"},
+		{"anchor_05", "$", "                     '$'"},
+		{"anchor_06", "a$b ^^a a$$", "           'a$b', '^a'^, 'a$'$"},
+		{"anchor_07", "\\^a a\\$", "               '^a', 'a$'"},
+		{"anchor_08", "~word:^a$", "             'a'iw^$"},
+		{"anchor_09", "^\"a b\"$ \"c\"$", "         'a b'^$, 'c'$"},
+		{"anchor_10", "^AND$", "                 'AND'^$"},
+		{"anchor_11", "(^a)", "                  (, 'a'^, )"},
+		{"anchor_12", "^", "                     '^'"},
+		{"anchor_13", "~^ a", "                  err: missing literal after '~^'"},
+		{"anchor_14", "/a\\$/", "                 err: invalid escape sequence \"\\\\$\""},
+		{"glob_01", "glob:a*b?", "                 'a*b?'g"},
+		{"glob_02", "~glob:^a*$", "                'a*'ig^$"},
+		{"glob_03", "glob:a\\*b\\?\\\\", "             'a\\*b\\?\\\\'g"},
+		{"glob_04", "glob:\"a *\"", "               'a *'g"},
+		{"glob_05", "glob:\"a\\\\*\"", "              'a\\*'g"},
+		{"glob_06", "a*b a\\*b", "                 'a*b', 'a*b'"},
+		{"glob_07", "word:glob:a", "               'glob:a'w"},
+		{"glob_08", "glob:", "                     'glob:'"},
+		{"glob_09", "/a\\*/", "                   err: invalid escape sequence \"\\\\*\""},
+		// NEAR and BEFORE
+		{"near_01", "a NEAR/5 b", "                'a', NEAR/5, 'b'"},
+		{"near_02", "(a)BEFORE/0(b)", "            (, 'a', ), BEFORE/0, (, 'b', )"},
+		{"near_03", "NEAR/1/a/", "                 err: invalid distance \"NEAR/1/a/\""},
+		{"near_04", "NEAR", "                      'NEAR'"},
+		{"near_05", "NEAR/", "                     err: invalid distance \"NEAR/\""},
+		{"near_06", "NEAR/x", "                    err: invalid distance \"NEAR/x\""},
+		{"near_07", "NEAR/+1", "                   err: invalid distance \"NEAR/+1\""},
+		{"near_08", "NEAR/99999999999999999999", " err: invalid distance \"NEAR/99999999999999999999\""},
+		{"near_09", "near/1 ~NEAR/1", "            'near', r[1 ~NEAR], '1'"},
+		{"near_10", "\"NEAR\"/1/", "                'NEAR', r[1]"},
+		// THEN
+		{"then_01", "a THEN b", "                  'a', THEN, 'b'"},
+		{"then_02", "then Then ~THEN", "           'then', 'Then', 'THEN'i"},
+		// xor, implies
+		{"xor_01", "a XOR b IMPLIES c", "          'a', XOR, 'b', IMPLIES, 'c'"},
+		{"xor_02", "xor Xor implies \"XOR\" IMPLIES$", "'xor', 'Xor', 'implies', 'XOR', 'IMPLIES'$"},
+		// threshold
+		{"threshold_01", "ATLEAST 2 (a, b,c)", "   ATLEAST 2, (, 'a', COMMA, 'b', COMMA, 'c', )"},
+		{"threshold_02", "EXACTLY 1(a) ATMOST 0 (/a,b/)", "EXACTLY 1, (, 'a', ), ATMOST 0, (, r[a,b], )"},
+		{"threshold_03", "a,b (a,b)", "            'a,b', (, 'a,b', )"},
+		{"threshold_04", "ATLEAST 1 ((a,b),c)", "  ATLEAST 1, (, (, 'a', COMMA, 'b', ), COMMA, 'c', )"},
+		{"threshold_05", "ATLEAST 1 (a\\,b, \"c,d\") e,f", "ATLEAST 1, (, 'a,b', COMMA, 'c,d', ), 'e,f'"},
+		{"threshold_06", "ATLEAST 1 (/a/i, b)", "  ATLEAST 1, (, r[a]i, COMMA, 'b', )"},
+		{"threshold_07", "ATLEAST (a)", "          err: missing count after 'ATLEAST'"},
+		{"threshold_08", "ATLEAST", "              err: missing count after 'ATLEAST'"},
+		{"threshold_09", "ATLEAST x (a)", "        err: invalid count \"x\""},
+		{"threshold_10", "ATLEAST ~1 (a)", "       err: invalid count \"~1\""},
+		{"threshold_11", "atleast \"ATLEAST\" 1", "  'atleast', 'ATLEAST', '1'"},
+		// occurrence counts
+		{"count_01", "a{2} b{2,} c{2,5}", "         'a'{2}, 'b'{2,}, 'c'{2,5}"},
+		{"count_02", "/a/{2} /b/i{0,1}", "          r[a]{2}, r[b]i{0,1}"},
+		{"count_03", "\"a b\"{3} ~a${1} ^a$\"\"", "   'a b'{3}, 'a'i${1}, 'a$\"\"'^"},
+		{"count_04", "(a{1})", "                    (, 'a'{1}, )"},
+		{"count_05", "a{2}b {2} {a} a{} a{,2}", "   'a{2}b', '{2}', '{a}', 'a{}', 'a{,2}'"},
+		{"count_06", "a\\{2} a\\{2,}", "           'a{2}', 'a{2,}'"},
+		{"count_07", "a{3,2}", "                    err: invalid count \"{3,2}\""},
+		{"count_08", "\"a\"{2}b", "                 err: count must end the literal"},
+		{"count_09", "~{2}", "                      err: missing literal after '~{2}'"},
+		{"count_10", "ATLEAST 1 (a{1,2}, b)", "     ATLEAST 1, (, 'a'{1,2}, COMMA, 'b', )"},
+		// quoted strings
+		{"quote_01", "\"a\"", "                     'a'"},
+		{"quote_02", "\"a b\" \"c\"", "               'a b', 'c'"},
+		{"quote_03", "\"\"", "                      ''"},
+		{"quote_04", "\"a\\tb\\nc\"", "              'a\tb\nc'"},
+		{"quote_05", "\"\\\"a\\\"\"", "               '\"a\"'"},
+		{"quote_06", "\"\\u00e9\\x41\"", "            'éA'"},
+		{"quote_07", "(\"AND\" AND \"(\")", "       (, 'AND', AND, '(', )"},
+		{"quote_08", "~\"A B\"", "                  'A B'i"},
+		{"quote_09", "\"a\"/b/", "                  'a', r[b]"},
+		{"quote_10", "a\"b\"", "                   'a\"b\"'"},
+		{"quote_11", "\\\"a", "                    '\"a'"},
+		{"quote_12", "\"a\\q\"", "                  err: invalid quoted string \"a\\q\""},
+		{"quote_13", "\"a b", "                    err: unclosed quoted string \"a b"},
+		{"quote_14", "\"a\\\"", "                   err: unclosed quoted string \"a\\\""},
 		// NOT
 		{"not_1", "NOT", "           NOT"},
 		{"not_2", "NOT NOT", "       NOT, NOT"},
@@ -102,6 +218,192 @@ func TestStringLexer(t *testing.T) {
 	}
 }
 
+func TestStringLexerExtended(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"a && b || c", "                  'a', AND, 'b', OR, 'c'"},
+		{"a and b or not c", "             'a', AND, 'b', OR, NOT, 'c'"},
+		{"(a)&&(b)", "                     (, 'a', ), AND, (, 'b', )"},
+		{"a&&b", "                         'a', AND, 'b'"},
+		{"(a||b)", "                       (, 'a', OR, 'b', )"},
+		{"~a&&b{2}||^c$", "                'a'i, AND, 'b'{2}, OR, 'c'^$"},
+		{"\"a&&b\" /a||b/ a&b|c", "         'a&&b', r[a||b], 'a&b|c'"},
+		{"a&&&b ||| c", "                  'a', AND, '&b', OR, '|', 'c'"},
+		{"a near/2||b&&c", "               'a', near/2, OR, 'b', AND, 'c'"},
+		{"/a/i&&atleast 1 (b||c)", "       r[a]i, AND, atleast 1, (, 'b', OR, 'c', )"},
+		{"AND And", "                      AND, 'And'"},
+		{"!a ! b !(c) !/d/ !~e", "         NOT, 'a', NOT, 'b', NOT, (, 'c', ), NOT, r[d], NOT, 'e'i"},
+		{"+a -b +\"c\" -(d)", "             'a', NOT, 'b', 'c', NOT, (, 'd', )"},
+		{"- + -) a-b", "                   '-', '+', '-', ), 'a-b'"},
+		{"--a", "                          NOT, NOT, 'a'"},
+		{"\\-a \\+b \\!c", "                  '-a', '+b', '!c'"},
+		{"/a/-b", "                        r[a], NOT, 'b'"},
+		{"a near/2 b before/3 c", "        'a', near/2, 'b', before/3, 'c'"},
+		{"a then b", "                     'a', THEN, 'b'"},
+		{"a xor b implies c", "            'a', XOR, 'b', IMPLIES, 'c'"},
+		{"atleast 1 (a) exactly 0 (b, c)", " atleast 1, (, 'a', ), exactly 0, (, 'b', COMMA, 'c', )"},
+	} {
+		lex, err := NewStringLexerWithOptions(tt.input, LexOptions{Extended: true})
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.want), collectAndDumpForTest(lex), "input %q", tt.input)
+	}
+	// the default dialect has none of these
+	lex, err := NewStringLexer("a && b or !c -d")
+	is.NoErr(err)
+	is.Eq("'a', '&&', 'b', 'or', '!c', '-d'", collectAndDumpForTest(lex))
+}
+
+func TestStringLexerGlob(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"user-*-prod conn?ct", "          'user-*-prod'g, 'conn?ct'g"},
+		{"a\\*b a\\?", "                  'a*b', 'a?'"},
+		{"a*\\* \\\\*", "                 'a*\\*'g, '\\\\*'g"},
+		{"\"a*\" glob:\"a*\"", "             'a*', 'a*'g"},
+		{"~A* ^a*$ a$", "                  'A*'ig, 'a*'g^$, 'a'$"},
+		{"word:a* * AND", "                'a*'w, '*'g, AND"},
+	} {
+		lex, err := NewStringLexerWithOptions(tt.input, LexOptions{Glob: true})
+		is.NoErr(err)
+		is.Eqf(strings.TrimSpace(tt.want), collectAndDumpForTest(lex), "input %q", tt.input)
+	}
+}
+
+func TestStringLexerRefs(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"$noise AND $a_1", "              $noise, AND, $a_1"},
+		{"($a)", "                         (, $a, )"},
+		{"$ $1 $a-b a$b", "                '$', '$1', '$a-b', 'a$b'"},
+		{"\\$a \"$a\" ~\"$a\"", "            '$a', '$a', '$a'i"},
+		{"ATLEAST 1 ($a,$b)", "            ATLEAST 1, (, $a, COMMA, $b, )"},
+		{"$a{2}", "                        err: invalid modifier for reference \"$a{2}\""},
+		{"~$a", "                          err: invalid modifier for reference \"~$a\""},
+	} {
+		lex, err := NewStringLexerWithOptions(tt.input, LexOptions{Refs: true})
+		have := ""
+		if err != nil {
+			have = "err: " + err.(*SyntaxError).Msg
+		} else {
+			have = collectAndDumpForTest(lex)
+		}
+		is.Eqf(strings.TrimSpace(tt.want), have, "input %q", tt.input)
+	}
+	// without Refs, references are string literals
+	lex, err := NewStringLexer("$a")
+	is.NoErr(err)
+	is.Eq("'$a'", collectAndDumpForTest(lex))
+}
+
+func TestStringLexerFuncs(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"@iban AND @vip_1", "                        @iban[], AND, @vip_1[]"},
+		{"@vip(gold, silver) (@a)", "                 @vip[\"gold\" \"silver\"], (, @a[], )"},
+		{"@ip( 10.0.0.0/8 ,::1/128 )", "              @ip[\"10.0.0.0/8\" \"::1/128\"]"},
+		{`@f("a, b", "(\"")`, "                        @f[\"a, b\" \"(\\\"\"]"},
+		{"@f() @f(a)b", "                             @f[], @f[\"a\"], 'b'"},
+		{"ATLEAST 1 (@f(a,b),c)", "                   ATLEAST 1, (, @f[\"a\" \"b\"], COMMA, 'c', )"},
+		{`@ \@a "@a" a@b @1 @a-b`, "                 '@', '@a', '@a', 'a@b', '@1', '@a-b'"},
+		{"/a/@f(x)", "                                r[a], @f[\"x\"]"},
+		{"~@a", "                                     err: invalid modifier for function call \"~@a\""},
+		{"@a{2}", "                                   err: invalid modifier for function call \"@a{2}\""},
+		{"@f(a", "                                    err: unclosed argument list"},
+		{"@f(a,)", "                                  err: missing argument"},
+		{"@f(a(b))", "                                err: unexpected \"(\" in argument list"},
+		{`@f("a)`, "                                  err: unclosed quoted string \"a)"},
+	} {
+		lex, err := NewStringLexerWithOptions(tt.input, LexOptions{Funcs: true})
+		have := ""
+		if err != nil {
+			have = "err: " + err.(*SyntaxError).Msg
+		} else {
+			have = collectAndDumpForTest(lex)
+		}
+		is.Eqf(strings.TrimSpace(tt.want), have, "input %q", tt.input)
+	}
+	// without Funcs, function calls are string literals
+	lex, err := NewStringLexer("@a(b)")
+	is.NoErr(err)
+	is.Eq("'@a', (, 'b', )", collectAndDumpForTest(lex))
+}
+
+func TestStringLexerBind(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	args := []string{"AND", "x) OR (y", "", "*$"}
+	for _, tt := range []testcase{
+		{"?", "                        'AND'"},
+		{"a AND ?", "                  'a', AND, 'AND'"},
+		{"level:? ? x?y", "            'level:AND', 'x) OR (y', 'xy'"},
+		{"~word:^?$", "                'AND'iw^$"},
+		{"? ?$ x? glob:?*", "          'AND', 'x) OR (y'$, 'x', '\\*$*'g"},
+		{"? ? ^?$", "                  'AND', 'x) OR (y', ''^$"},
+		{"? ? ?", "                    err: empty value for placeholder"},
+		{"? ? ~?", "                   err: empty value for placeholder"},
+		{`\? "?" /a?/`, "             '?', '?', r[a?]"},
+		{"(?)", "                      (, 'AND', )"},
+		{"ATLEAST 1 (?,?)", "          ATLEAST 1, (, 'AND', COMMA, 'x) OR (y', )"},
+		{"ATLEAST ? (a)", "            err: invalid count \"?\""},
+		{"a NEAR/? b", "               err: invalid distance \"NEAR/?\""},
+	} {
+		lex, err := NewStringLexerWithOptions(tt.input, LexOptions{Bind: func(i int) string { return args[i%len(args)] }})
+		have := ""
+		if err != nil {
+			have = "err: " + err.(*SyntaxError).Msg
+		} else {
+			have = collectAndDumpForTest(lex)
+		}
+		is.Eqf(strings.TrimSpace(tt.want), have, "input %q", tt.input)
+	}
+	// without Bind, '?' is a plain character
+	lex, err := NewStringLexer("? a?")
+	is.NoErr(err)
+	is.Eq("'?', 'a?'", collectAndDumpForTest(lex))
+}
+
+func TestStringLexerPositions(t *testing.T) {
+	is := Assert(t)
+	lex, err := NewStringLexer("(ab AND /c d/i)\\ x ~y")
+	is.NoErr(err)
+	var have []string
+	for {
+		tok, err := lex.NextToken()
+		is.NoErr(err)
+		have = append(have, fmt.Sprintf("%d-%d", tok.Pos, tok.End))
+		if tok.IsEOF() {
+			break
+		}
+	}
+	is.Eq("0-1 1-3 4-7 8-14 14-15 15-18 19-21 21-21", strings.Join(have, " "))
+}
+
+func dumpCount(t Token) string {
+	if t.Count == "" {
+		return ""
+	}
+	return "{" + t.Count + "}"
+}
+
 func collectAndDumpForTest(lex Lexer) string {
 	var toks []string
 	for range 100 {
@@ -120,10 +422,26 @@ func collectAndDumpForTest(lex Lexer) string {
 			toks = append(toks, "AND")
 		case OrToken:
 			toks = append(toks, "OR")
+		case XorToken:
+			toks = append(toks, "XOR")
+		case ImpliesToken:
+			toks = append(toks, "IMPLIES")
 		case StringToken:
-			toks = append(toks, "'"+t.Text+"'")
+			toks = append(toks, "'"+t.Text+"'"+t.Flags+dumpCount(t))
 		case RegexToken:
-			toks = append(toks, "r["+t.Text+"]")
+			toks = append(toks, "r["+t.Text+"]"+t.Flags+dumpCount(t))
+		case NearToken, BeforeToken:
+			toks = append(toks, t.Text)
+		case ThenToken:
+			toks = append(toks, "THEN")
+		case RefToken:
+			toks = append(toks, "$"+t.Text)
+		case FuncToken:
+			toks = append(toks, fmt.Sprintf("@%s%q", t.Text, t.Args))
+		case ThresholdToken:
+			toks = append(toks, t.Text)
+		case CommaToken:
+			toks = append(toks, "COMMA")
 		case EOFToken:
 			return strings.Join(toks, ", ")
 		default:
@@ -3,21 +3,39 @@ package internal
 import (
 	"fmt"
 	"slices"
+	"strconv"
 )
 
+// ParseOptions control parsing.
+type ParseOptions struct {
+	MaxTokens   int  // maximum number of tokens, if zero, DefaultMaxTokens is used
+	ImplicitAnd bool // join adjacent operands with an implicit AND
+}
+
+// DefaultMaxTokens is the default maximum number of tokens of an expression.
+const DefaultMaxTokens = 1000
+
 // Parse input tokens and build an abstract syntax tree.
 // It's a L-R parser with a one-token lookahead.
 func Parse(lex Lexer) (Node, error) {
-	stack := &stack{nil}
+	return ParseWithOptions(lex, ParseOptions{})
+}
+
+// ParseWithOptions is like Parse but with options.
+func ParseWithOptions(lex Lexer, opts ParseOptions) (Node, error) {
+	stack := &stack{implicitAnd: opts.ImplicitAnd}
 	lookahead, err := lex.NextToken()
 	if err != nil {
 		return Node{}, err
 	}
 	if lookahead.IsEOF() {
 		// fast path for empty input: match everything
-		return Node{StringNode, "", nil}, nil
+		return Node{Typ: StringNode, Pos: lookahead.Pos, End: lookahead.End}, nil
+	}
+	maxTokens := opts.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
 	}
-	const maxTokens = 1000 // prevent endless loop
 	for range maxTokens {
 		// process next token
 		token := lookahead
@@ -25,10 +43,20 @@ func Parse(lex Lexer) (Node, error) {
 		if err != nil {
 			return Node{}, err
 		}
+		// an operand that follows an operand is joined by an implicit AND
+		if opts.ImplicitAnd && token.startsOperand() && stack.len() > 0 && stack.last().isNode() {
+			stack.push(Token{Typ: AndToken, Text: "AND", Pos: token.Pos, End: token.Pos})
+		}
 		// shift (push token onto stack)
 		stack.push(token)
 		// reduce (build nodes from stack)
-		stack.reduce(lookahead)
+		if err := stack.reduce(lookahead, maxTokens+1); err != nil {
+			return Node{}, err
+		}
+		// is it still valid?
+		if n, expected := stack.scan(); n < stack.len() {
+			return Node{}, unexpected(token, expected)
+		}
 		// did it terminate?
 		if lookahead.Typ == EOFToken {
 			if stack.len() == 1 {
@@ -37,10 +65,29 @@ func Parse(lex Lexer) (Node, error) {
 					return item.node, nil
 				}
 			}
-			return Node{}, fmt.Errorf("syntax error")
+			_, expected := stack.scan()
+			return Node{}, unexpected(lookahead, expected)
 		}
 	}
-	return Node{}, fmt.Errorf("too many tokens")
+	return Node{}, &SyntaxError{lookahead.Pos, lookahead.End, fmt.Sprintf("too many tokens, maximum is %d", maxTokens), nil}
+}
+
+// unexpected returns a syntax error for an unexpected token.
+func unexpected(token Token, expected []string) error {
+	var desc string
+	switch token.Typ {
+	case EOFToken:
+		desc = "end of expression"
+	case RegexToken:
+		desc = strconv.Quote("/" + token.Text + "/")
+	case RefToken:
+		desc = strconv.Quote("$" + token.Text)
+	case FuncToken:
+		desc = strconv.Quote(FormatCall(token.Text, token.Args))
+	default:
+		desc = strconv.Quote(token.Text)
+	}
+	return &SyntaxError{token.Pos, token.End, "unexpected " + desc, expected}
 }
 
 // A Node is a node in the parse tree.
@@ -48,6 +95,11 @@ type Node struct {
 	Typ      NodeTyp
 	Text     string
 	Subnodes []Node
+	Pos      int      // byte offset of the first character in the input
+	End      int      // byte offset after the last character in the input
+	Flags    string   // literal modifiers, see Token.Flags
+	Count    string   // occurrence count of a literal, see Token.Count
+	Args     []string // arguments of a function call
 }
 
 func (n Node) isZero() bool { return int(n.Typ) == 0 }
@@ -58,14 +110,23 @@ const (
 	_ NodeTyp = iota
 	StringNode
 	RegexNode
+	RefNode  // Text is the name
+	FuncNode // Text is the name
 	NotNode
 	AndNode
 	OrNode
+	XorNode
+	ImpliesNode
+	NearNode   // Text is "NEAR/n"
+	BeforeNode // Text is "BEFORE/n"
+	ThenNode
+	ThresholdNode // Text is "ATLEAST k", "EXACTLY k" or "ATMOST k"
 )
 
 // A stack holds stack items, which can be tokens or nodes.
 type stack struct {
-	items []stackitem
+	items       []stackitem
+	implicitAnd bool
 }
 
 func (s *stack) len() int {
@@ -76,36 +137,139 @@ func (s *stack) first() stackitem {
 	return s.items[0]
 }
 
+func (s *stack) last() stackitem {
+	return s.items[len(s.items)-1]
+}
+
 func (s *stack) push(token Token) {
 	s.items = append(s.items, stackitem{token: token})
 }
 
+// scan checks that the stack holds a valid beginning of an expression, that
+// is a sequence of "(", "NOT", "ATLEAST k" "(" and node followed by a binary
+// operator or, in an operand list, a comma, optionally followed by a node.
+// It returns the number of leading items that are valid and what may follow
+// them.
+func (s *stack) scan() (int, []string) {
+	operand := true   // an operand is expected
+	list := false     // an operand list is expected
+	var parens []bool // unclosed parentheses, true for operand lists
+	for i, item := range s.items {
+		if list {
+			if !item.isTokenOf(OpenToken) {
+				return i, []string{"("}
+			}
+			parens = append(parens, true)
+			list = false
+		} else if operand {
+			switch {
+			case item.isTokenOf(OpenToken):
+				parens = append(parens, false)
+			case item.isTokenOf(NotToken):
+				// still expecting an operand
+			case item.isTokenOf(ThresholdToken):
+				list = true
+			case item.isNode():
+				operand = false
+			default:
+				return i, expectedOperand()
+			}
+		} else {
+			switch {
+			case item.isTokenOf(AndToken), item.isTokenOf(OrToken), item.isTokenOf(XorToken), item.isTokenOf(ImpliesToken),
+				item.isTokenOf(NearToken), item.isTokenOf(BeforeToken), item.isTokenOf(ThenToken):
+				operand = true
+			case item.isTokenOf(CommaToken) && inList(parens):
+				operand = true
+			default:
+				return i, s.expectedOperator(parens)
+			}
+		}
+	}
+	if list {
+		return len(s.items), []string{"("}
+	}
+	if operand {
+		return len(s.items), expectedOperand()
+	}
+	return len(s.items), s.expectedOperator(parens)
+}
+
+// inList reports whether the innermost unclosed parenthesis starts
+// an operand list.
+func inList(parens []bool) bool {
+	return len(parens) > 0 && parens[len(parens)-1]
+}
+
+func expectedOperand() []string {
+	return []string{"literal", "(", "NOT", "ATLEAST", "EXACTLY", "ATMOST"}
+}
+
+func (s *stack) expectedOperator(parens []bool) []string {
+	expected := []string{"AND", "OR", "XOR", "IMPLIES", "NEAR/n", "BEFORE/n", "THEN"}
+	if s.implicitAnd {
+		expected = append(expected, expectedOperand()...)
+	}
+	if inList(parens) {
+		return append(expected, ",", ")")
+	}
+	if len(parens) > 0 {
+		return append(expected, ")")
+	}
+	return append(expected, "end of expression")
+}
+
 // reduce reduces the stack by creating nodes according to the
 // following reduction rules:
 //
-//	literal          --> node  // string or regex
-//	"(" node ")"     --> node
-//	"NOT" node       --> node
-//	node "AND" node  --> node
-//	node "OR" node   --> (lookahead "OR", ")", EOF)  -->  node
-func (s *stack) reduce(lookahead Token) error {
-	const maxRounds = 100
+//	literal             --> node  // string, regex or reference
+//	"ATLEAST k" "(" node { "," node } ")"  --> node  // also "EXACTLY k", "ATMOST k"
+//	"(" node ")"        --> node
+//	"NOT" node          --> node
+//	node "NEAR/n" node  --> node  // also "BEFORE/n"
+//	node "THEN" node    --> node
+//	node "AND" node     --> (lookahead not "NEAR/n", "BEFORE/n", "THEN")  -->  node
+//	node "XOR" node     --> (lookahead "XOR", "OR", "IMPLIES", ",", ")", EOF)  -->  node
+//	node "OR" node      --> (lookahead "OR", "IMPLIES", ",", ")", EOF)  -->  node
+//	node "IMPLIES" node --> (lookahead ",", ")", EOF)  -->  node
+//
+// Chains of AND, XOR, OR and THEN are flattened into one node with many
+// subnodes. IMPLIES is right-associative and not flattened.
+//
+// Every round turns a literal token into a node or removes stack items,
+// so a stack of n items needs at most n+1 rounds.
+func (s *stack) reduce(lookahead Token, maxRounds int) error {
 	for range maxRounds {
 		if s.reduceLiteralToken() {
 			continue
 		}
+		if s.reduceListToken() {
+			continue
+		}
 		if s.reduceOpenCloseToken() {
 			continue
 		}
 		if s.reduceNotToken() {
 			continue
 		}
-		if s.reduceAndToken() {
+		if s.reduceNearToken() {
+			continue
+		}
+		if s.reduceThenToken() {
+			continue
+		}
+		if s.reduceAndToken(lookahead) {
+			continue
+		}
+		if s.reduceXorToken(lookahead) {
 			continue
 		}
 		if s.reduceOrToken(lookahead) {
 			continue
 		}
+		if s.reduceImpliesToken(lookahead) {
+			continue
+		}
 		return nil
 	}
 	return fmt.Errorf("too many reduce rounds")
@@ -116,11 +280,19 @@ func (s *stack) reduceLiteralToken() bool {
 	if nitems >= 1 {
 		item := s.items[nitems-1]
 		if item.isTokenOf(StringToken) {
-			newNode := Node{Typ: StringNode, Text: item.token.Text}
+			newNode := Node{Typ: StringNode, Text: item.token.Text, Pos: item.token.Pos, End: item.token.End, Flags: item.token.Flags, Count: item.token.Count}
 			s.replaceItems(nitems-1, nitems-1, newNode)
 			return true
 		} else if item.isTokenOf(RegexToken) {
-			newNode := Node{Typ: RegexNode, Text: item.token.Text}
+			newNode := Node{Typ: RegexNode, Text: item.token.Text, Pos: item.token.Pos, End: item.token.End, Flags: item.token.Flags, Count: item.token.Count}
+			s.replaceItems(nitems-1, nitems-1, newNode)
+			return true
+		} else if item.isTokenOf(RefToken) {
+			newNode := Node{Typ: RefNode, Text: item.token.Text, Pos: item.token.Pos, End: item.token.End}
+			s.replaceItems(nitems-1, nitems-1, newNode)
+			return true
+		} else if item.isTokenOf(FuncToken) {
+			newNode := Node{Typ: FuncNode, Text: item.token.Text, Pos: item.token.Pos, End: item.token.End, Args: item.token.Args}
 			s.replaceItems(nitems-1, nitems-1, newNode)
 			return true
 		}
@@ -134,7 +306,7 @@ func (s *stack) reduceNotToken() bool {
 		i1 := s.items[nitems-2] // NOT
 		i2 := s.items[nitems-1] // node
 		if i1.isTokenOf(NotToken) && i2.isNode() {
-			newNode := Node{Typ: NotNode, Text: i1.token.Text, Subnodes: []Node{i2.node}}
+			newNode := Node{Typ: NotNode, Text: i1.token.Text, Subnodes: []Node{i2.node}, Pos: i1.token.Pos, End: i2.node.End}
 			s.replaceItems(nitems-2, nitems, newNode)
 			return true
 		}
@@ -142,14 +314,58 @@ func (s *stack) reduceNotToken() bool {
 	return false
 }
 
-func (s *stack) reduceAndToken() bool {
+func (s *stack) reduceNearToken() bool {
+	nitems := len(s.items)
+	if nitems >= 3 {
+		i1 := s.items[nitems-3] // node
+		i2 := s.items[nitems-2] // NEAR/n or BEFORE/n
+		i3 := s.items[nitems-1] // node
+		if i1.isNode() && i3.isNode() {
+			var typ NodeTyp
+			switch {
+			case i2.isTokenOf(NearToken):
+				typ = NearNode
+			case i2.isTokenOf(BeforeToken):
+				typ = BeforeNode
+			default:
+				return false
+			}
+			newNode := Node{Typ: typ, Text: i2.token.Text, Subnodes: []Node{i1.node, i3.node}, Pos: i1.node.Pos, End: i3.node.End}
+			s.replaceItems(nitems-3, nitems, newNode)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stack) reduceThenToken() bool {
+	nitems := len(s.items)
+	if nitems >= 3 {
+		i1 := s.items[nitems-3] // node
+		i2 := s.items[nitems-2] // THEN
+		i3 := s.items[nitems-1] // node
+		if i1.isNode() && i2.isTokenOf(ThenToken) && i3.isNode() {
+			newNode := Node{Typ: ThenNode, Text: i2.token.Text, Subnodes: flatten(ThenNode, i1.node, i3.node), Pos: i1.node.Pos, End: i3.node.End}
+			s.replaceItems(nitems-3, nitems, newNode)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stack) reduceAndToken(lookahead Token) bool {
+	switch lookahead.Typ {
+	case NearToken, BeforeToken, ThenToken:
+		// NEAR, BEFORE and THEN bind stronger than AND
+		return false
+	}
 	nitems := len(s.items)
 	if nitems >= 3 {
 		i1 := s.items[nitems-3] // node
 		i2 := s.items[nitems-2] // AND
 		i3 := s.items[nitems-1] // node
 		if i1.isNode() && i2.isTokenOf(AndToken) && i3.isNode() {
-			newNode := Node{Typ: AndNode, Text: i2.token.Text, Subnodes: []Node{i1.node, i3.node}}
+			newNode := Node{Typ: AndNode, Text: i2.token.Text, Subnodes: flatten(AndNode, i1.node, i3.node), Pos: i1.node.Pos, End: i3.node.End}
 			s.replaceItems(nitems-3, nitems, newNode)
 			return true
 		}
@@ -159,14 +375,52 @@ func (s *stack) reduceAndToken() bool {
 
 func (s *stack) reduceOrToken(lookahead Token) bool {
 	switch lookahead.Typ {
-	case CloseToken, OrToken, EOFToken:
+	case CloseToken, CommaToken, OrToken, ImpliesToken, EOFToken:
 		nitems := len(s.items)
 		if nitems >= 3 {
 			i1 := s.items[nitems-3] // node
 			i2 := s.items[nitems-2] // OR
 			i3 := s.items[nitems-1] // node
 			if i1.isNode() && i2.isTokenOf(OrToken) && i3.isNode() {
-				newNode := Node{Typ: OrNode, Text: i2.token.Text, Subnodes: []Node{i1.node, i3.node}}
+				newNode := Node{Typ: OrNode, Text: i2.token.Text, Subnodes: flatten(OrNode, i1.node, i3.node), Pos: i1.node.Pos, End: i3.node.End}
+				s.replaceItems(nitems-3, nitems, newNode)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *stack) reduceXorToken(lookahead Token) bool {
+	switch lookahead.Typ {
+	case CloseToken, CommaToken, XorToken, OrToken, ImpliesToken, EOFToken:
+		nitems := len(s.items)
+		if nitems >= 3 {
+			i1 := s.items[nitems-3] // node
+			i2 := s.items[nitems-2] // XOR
+			i3 := s.items[nitems-1] // node
+			if i1.isNode() && i2.isTokenOf(XorToken) && i3.isNode() {
+				newNode := Node{Typ: XorNode, Text: i2.token.Text, Subnodes: flatten(XorNode, i1.node, i3.node), Pos: i1.node.Pos, End: i3.node.End}
+				s.replaceItems(nitems-3, nitems, newNode)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *stack) reduceImpliesToken(lookahead Token) bool {
+	switch lookahead.Typ {
+	case CloseToken, CommaToken, EOFToken:
+		// IMPLIES is right-associative: 'a IMPLIES b IMPLIES c' is
+		// reduced from the right
+		nitems := len(s.items)
+		if nitems >= 3 {
+			i1 := s.items[nitems-3] // node
+			i2 := s.items[nitems-2] // IMPLIES
+			i3 := s.items[nitems-1] // node
+			if i1.isNode() && i2.isTokenOf(ImpliesToken) && i3.isNode() {
+				newNode := Node{Typ: ImpliesNode, Text: i2.token.Text, Subnodes: []Node{i1.node, i3.node}, Pos: i1.node.Pos, End: i3.node.End}
 				s.replaceItems(nitems-3, nitems, newNode)
 				return true
 			}
@@ -175,6 +429,52 @@ func (s *stack) reduceOrToken(lookahead Token) bool {
 	return false
 }
 
+// flatten returns the operands of an associative operator of type typ.
+// Operands that are of type typ themselves are merged, so that chains
+// like 'a OR b OR c' result in one node with three subnodes instead of
+// a deeply nested tree.
+func flatten(typ NodeTyp, nodes ...Node) []Node {
+	var subnodes []Node
+	for _, node := range nodes {
+		if node.Typ == typ {
+			subnodes = append(subnodes, node.Subnodes...)
+		} else {
+			subnodes = append(subnodes, node)
+		}
+	}
+	return subnodes
+}
+
+func (s *stack) reduceListToken() bool {
+	nitems := len(s.items)
+	if nitems < 4 || !s.items[nitems-1].isTokenOf(CloseToken) {
+		return false
+	}
+	// walk back over the operands and commas to the opening parenthesis
+	var subnodes []Node
+	i := nitems - 2
+	for {
+		if i < 0 || !s.items[i].isNode() {
+			return false
+		}
+		subnodes = append(subnodes, s.items[i].node)
+		if i < 1 || !s.items[i-1].isTokenOf(CommaToken) {
+			i--
+			break
+		}
+		i -= 2
+	}
+	if i < 1 || !s.items[i].isTokenOf(OpenToken) || !s.items[i-1].isTokenOf(ThresholdToken) {
+		return false
+	}
+	slices.Reverse(subnodes)
+	i1 := s.items[i-1]      // ATLEAST k
+	i2 := s.items[nitems-1] // )
+	newNode := Node{Typ: ThresholdNode, Text: i1.token.Text, Subnodes: subnodes, Pos: i1.token.Pos, End: i2.token.End}
+	s.replaceItems(i-1, nitems, newNode)
+	return true
+}
+
 func (s *stack) reduceOpenCloseToken() bool {
 	nitems := len(s.items)
 	if nitems >= 3 {
@@ -182,7 +482,9 @@ func (s *stack) reduceOpenCloseToken() bool {
 		i2 := s.items[nitems-2] // node
 		i3 := s.items[nitems-1] // )
 		if i1.isTokenOf(OpenToken) && i2.isNode() && i3.isTokenOf(CloseToken) {
-			s.replaceItems(nitems-3, nitems, i2.node)
+			newNode := i2.node
+			newNode.Pos, newNode.End = i1.token.Pos, i3.token.End
+			s.replaceItems(nitems-3, nitems, newNode)
 			return true
 		}
 	}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -16,68 +17,131 @@ func TestParse(t *testing.T) {
 		{"", ""},
 		// text expressions
 		{"a", "                    a"},
-		{"a b", "                  err: syntax error"},
+		{"a b", "                  err: unexpected \"b\" at 2"},
 		// NOT
 		{"NOT a", "                NOT[a]"},
 		{"NOT NOT a", "            NOT[NOT[a]]"},
 		{"NOT NOT NOT a", "        NOT[NOT[NOT[a]]]"},
-		{"NOT", "                  err: syntax error"},
-		{"a NOT", "                err: syntax error"},
-		{"a NOT b", "              err: syntax error"},
+		{"NOT", "                  err: unexpected end of expression at 3"},
+		{"a NOT", "                err: unexpected \"NOT\" at 2"},
+		{"a NOT b", "              err: unexpected \"NOT\" at 2"},
 		// AND
-		{"AND", "                  err: syntax error"},
-		{"AND AND", "              err: syntax error"},
-		{"a AND", "                err: syntax error"},
+		{"AND", "                  err: unexpected \"AND\" at 0"},
+		{"AND AND", "              err: unexpected \"AND\" at 0"},
+		{"a AND", "                err: unexpected end of expression at 5"},
 		{"a AND b", "              AND[a,b]"},
-		{"a AND AND b", "          err: syntax error"},
-		{"a AND b AND", "          err: syntax error"},
-		{"a AND b AND c", "        AND[AND[a,b],c]"},
-		{"a AND b AND c AND d", "  AND[AND[AND[a,b],c],d]"},
+		{"a AND AND b", "          err: unexpected \"AND\" at 6"},
+		{"a AND b AND", "          err: unexpected end of expression at 11"},
+		{"a AND b AND c", "        AND[a,b,c]"},
+		{"a AND b AND c AND d", "  AND[a,b,c,d]"},
 		// NOT & AND
-		{"NOT AND", "              err: syntax error"},
-		{"AND NOT", "              err: syntax error"},
-		{"a AND NOT", "            err: syntax error"},
+		{"NOT AND", "              err: unexpected \"AND\" at 4"},
+		{"AND NOT", "              err: unexpected \"AND\" at 0"},
+		{"a AND NOT", "            err: unexpected end of expression at 9"},
 		{"a AND NOT b", "          AND[a,NOT[b]]"},
 		{"NOT a AND NOT b", "      AND[NOT[a],NOT[b]]"},
 		{"NOT a AND NOT NOT b", "  AND[NOT[a],NOT[NOT[b]]]"},
 		{"NOT a AND b", "          AND[NOT[a],b]"},
 		// OR
-		{"OR", "                   err: syntax error"},
-		{"OR OR", "                err: syntax error"},
-		{"a OR", "                 err: syntax error"},
+		{"OR", "                   err: unexpected \"OR\" at 0"},
+		{"OR OR", "                err: unexpected \"OR\" at 0"},
+		{"a OR", "                 err: unexpected end of expression at 4"},
 		{"a OR b", "               OR[a,b]"},
-		{"a OR OR b", "            err: syntax error"},
-		{"a OR b OR", "            err: syntax error"},
-		{"a OR b OR c", "          OR[OR[a,b],c]"},
-		{"a OR b OR c OR d", "     OR[OR[OR[a,b],c],d]"},
+		{"a OR OR b", "            err: unexpected \"OR\" at 5"},
+		{"a OR b OR", "            err: unexpected end of expression at 9"},
+		{"a OR b OR c", "          OR[a,b,c]"},
+		{"a OR b OR c OR d", "     OR[a,b,c,d]"},
 		// NOT & AND & OR
 		{"a AND b OR c", "         OR[AND[a,b],c]"},
-		{"a AND b OR c AND", "     err: syntax error"},
+		{"a AND b OR c AND", "     err: unexpected end of expression at 16"},
 		{"a AND b OR c AND d", "   OR[AND[a,b],AND[c,d]]"},
-		{"a OR b AND c OR", "      err: syntax error"},
-		{"a OR b AND c OR d", "    OR[OR[a,AND[b,c]],d]"},
-		{"a OR NOT", "             err: syntax error"},
+		{"a OR b AND c OR", "      err: unexpected end of expression at 15"},
+		{"a OR b AND c OR d", "    OR[a,AND[b,c],d]"},
+		{"a OR NOT", "             err: unexpected end of expression at 8"},
 		{"a OR NOT b", "           OR[a,NOT[b]]"},
-		{"a OR NOT b NOT e", "     err: syntax error"},
+		{"a OR NOT b NOT e", "     err: unexpected \"NOT\" at 11"},
 		{"a OR NOT b AND NOT e", " OR[a,AND[NOT[b],NOT[e]]]"},
+		// NEAR & BEFORE
+		{"a NEAR/3 b", "           NEAR/3[a,b]"},
+		{"a BEFORE/0 b", "         BEFORE/0[a,b]"},
+		{"NEAR/3", "               err: unexpected \"NEAR/3\" at 0"},
+		{"a NEAR/3", "             err: unexpected end of expression at 8"},
+		{"a NEAR/3 NEAR/3 b", "    err: unexpected \"NEAR/3\" at 9"},
+		{"a NEAR/1 b NEAR/2 c", "  NEAR/2[NEAR/1[a,b],c]"},
+		{"a AND b NEAR/1 c", "     AND[a,NEAR/1[b,c]]"},
+		{"a NEAR/1 b AND c", "     AND[NEAR/1[a,b],c]"},
+		{"a AND b NEAR/1 c AND d", " AND[a,NEAR/1[b,c],d]"},
+		{"a OR b BEFORE/1 c", "    OR[a,BEFORE/1[b,c]]"},
+		{"NOT a NEAR/1 NOT b", "   NEAR/1[NOT[a],NOT[b]]"},
+		{"a NEAR/1 ( b OR c )", "  NEAR/1[a,OR[b,c]]"},
+		// THEN
+		{"a THEN b", "             THEN[a,b]"},
+		{"a THEN", "               err: unexpected end of expression at 6"},
+		{"a THEN b THEN c", "      THEN[a,b,c]"},
+		{"a THEN ( b THEN c )", "  THEN[a,b,c]"},
+		{"a AND b THEN c", "       AND[a,THEN[b,c]]"},
+		{"a THEN b OR c", "        OR[THEN[a,b],c]"},
+		{"a THEN b NEAR/1 c", "    NEAR/1[THEN[a,b],c]"},
+		{"a NEAR/1 b THEN c", "    THEN[NEAR/1[a,b],c]"},
+		{"NOT a THEN b", "         THEN[NOT[a],b]"},
+		// references
+		{"$a", "                             $a"},
+		{"$a AND NOT $b", "                  AND[$a,NOT[$b]]"},
+		{"$a $b", "                          err: unexpected \"$b\" at 3"},
+		// XOR
+		{"a XOR b", "                        XOR[a,b]"},
+		{"a XOR b XOR c", "                  XOR[a,b,c]"},
+		{"a XOR b AND c", "                  XOR[a,AND[b,c]]"},
+		{"a AND b XOR c", "                  XOR[AND[a,b],c]"},
+		{"a OR b XOR c", "                   OR[a,XOR[b,c]]"},
+		{"a XOR b OR c", "                   OR[XOR[a,b],c]"},
+		{"a XOR b THEN c", "                 XOR[a,THEN[b,c]]"},
+		{"NOT a XOR b", "                    XOR[NOT[a],b]"},
+		{"a XOR", "                          err: unexpected end of expression at 5"},
+		// IMPLIES
+		{"a IMPLIES b", "                    IMPLIES[a,b]"},
+		{"a IMPLIES b IMPLIES c", "          IMPLIES[a,IMPLIES[b,c]]"},
+		{"( a IMPLIES b ) IMPLIES c", "      IMPLIES[IMPLIES[a,b],c]"},
+		{"a OR b IMPLIES c AND d", "         IMPLIES[OR[a,b],AND[c,d]]"},
+		{"a IMPLIES b OR c", "               IMPLIES[a,OR[b,c]]"},
+		{"a XOR b IMPLIES c XOR d", "        IMPLIES[XOR[a,b],XOR[c,d]]"},
+		{"ATLEAST_1 ( a IMPLIES b , c )", "  ATLEAST 1[IMPLIES[a,b],c]"},
+		{"IMPLIES a", "                      err: unexpected \"IMPLIES\" at 0"},
+		// ATLEAST, EXACTLY, ATMOST
+		{"ATLEAST_2 ( a , b , c )", "        ATLEAST 2[a,b,c]"},
+		{"EXACTLY_1 ( a )", "                EXACTLY 1[a]"},
+		{"ATMOST_1 ( a OR b , c AND d )", "  ATMOST 1[OR[a,b],AND[c,d]]"},
+		{"ATLEAST_1 ( ( a ) , NOT b )", "    ATLEAST 1[a,NOT[b]]"},
+		{"ATLEAST_1 ( ATMOST_0 ( a ) , b )", "ATLEAST 1[ATMOST 0[a],b]"},
+		{"NOT ATLEAST_1 ( a ) AND b", "      AND[NOT[ATLEAST 1[a]],b]"},
+		{"a OR ATLEAST_1 ( b ) THEN c", "    OR[a,THEN[ATLEAST 1[b],c]]"},
+		{"ATLEAST_1", "                      err: unexpected end of expression at 9"},
+		{"ATLEAST_1 a", "                    err: unexpected \"a\" at 10"},
+		{"ATLEAST_1 ( )", "                  err: unexpected \")\" at 12"},
+		{"ATLEAST_1 ( a , )", "              err: unexpected \")\" at 16"},
+		{"ATLEAST_1 ( , a )", "              err: unexpected \",\" at 12"},
+		{"ATLEAST_1 ( a , b", "              err: unexpected end of expression at 17"},
+		{"( a , b )", "                      err: unexpected \",\" at 4"},
+		{"ATLEAST_1 ( ( a , b ) )", "        err: unexpected \",\" at 16"},
+		{"a , b", "                          err: unexpected \",\" at 2"},
 		// Parentheses
-		{"(", "                    err: syntax error"},
-		{")", "                    err: syntax error"},
+		{"(", "                    err: unexpected end of expression at 1"},
+		{")", "                    err: unexpected \")\" at 0"},
 		{"( a )", "                a"},
-		{"a )", "                  err: syntax error"},
-		{"( a", "                  err: syntax error"},
-		{"( ( a )", "              err: syntax error"},
-		{"( a ) )", "              err: syntax error"},
-		{"( a b )", "              err: syntax error"},
-		{"( a ) ( b )", "          err: syntax error"},
+		{"a )", "                  err: unexpected \")\" at 2"},
+		{"( a", "                  err: unexpected end of expression at 3"},
+		{"( ( a )", "              err: unexpected end of expression at 7"},
+		{"( a ) )", "              err: unexpected \")\" at 6"},
+		{"( a b )", "              err: unexpected \"b\" at 4"},
+		{"( a ) ( b )", "          err: unexpected \"(\" at 6"},
 		// Parentheses & NOT & AND & OR
 		{"( a )", "                   a"},
 		{"( NOT a )", "               NOT[a]"},
 		{"( ( NOT a ) )", "           NOT[a]"},
 		{"NOT ( a )", "               NOT[a]"},
 		{"NOT ( ( a ) )", "           NOT[a]"},
-		{"NOT ( a ) )", "             err: syntax error"},
-		{"NOT ( ( a )", "             err: syntax error"},
+		{"NOT ( a ) )", "             err: unexpected \")\" at 10"},
+		{"NOT ( ( a )", "             err: unexpected end of expression at 11"},
 		{"( a ) AND ( b )", "                    AND[a,b]"},
 		{"( a ) AND ( NOT b )", "                AND[a,NOT[b]]"},
 		{"( a AND b ) OR c", "                   OR[AND[a,b],c]"},
@@ -85,6 +149,9 @@ func TestParse(t *testing.T) {
 		{"( a ) AND ( e OR f )", "               AND[a,OR[e,f]]"},
 		{"( a OR b ) AND NOT ( c OR NOT d )", "                       AND[OR[a,b],NOT[OR[c,NOT[d]]]]"},
 		{"( a OR ( b AND c ) ) AND ( NOT g OR NOT ( h AND i ) )", "   AND[OR[a,AND[b,c]],OR[NOT[g],NOT[AND[h,i]]]]"},
+		{"( a AND b ) AND ( c AND d )", "                             AND[a,b,c,d]"},
+		{"a OR ( b OR c ) OR d", "                                    OR[a,b,c,d]"},
+		{"a OR ( b AND c ) OR ( d OR NOT ( e OR f ) )", "            OR[a,AND[b,c],d,NOT[OR[e,f]]]"},
 	} {
 		t.Logf("testcase '%s'", tt.input)
 		lex := newFakeLexer(tt.input)
@@ -95,7 +162,8 @@ func TestParse(t *testing.T) {
 				is.Failf("testcase '%s': want err but was ok", tt.input)
 			}
 			want := want[5:]
-			have := err.Error()
+			serr := err.(*SyntaxError)
+			have := fmt.Sprintf("%s at %d", serr.Msg, serr.Pos)
 			if have != want {
 				is.Failf("testcase '%s'\nwant error '%s'\nhave error '%s'", tt.input, want, have)
 			}
@@ -111,11 +179,87 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseWithOptions(t *testing.T) {
+	is := Assert(t)
+	input := strings.TrimSpace(strings.Repeat("NOT ", 1500) + "a")
+	_, err := Parse(newFakeLexer(input))
+	is.Eq("too many tokens, maximum is 1000", err.Error())
+	node, err := ParseWithOptions(newFakeLexer(input), ParseOptions{MaxTokens: 1501})
+	is.NoErr(err)
+	is.Eq(NotNode, node.Typ)
+	_, err = ParseWithOptions(newFakeLexer("a AND b"), ParseOptions{MaxTokens: 2})
+	is.Eq("too many tokens, maximum is 2", err.Error())
+}
+
+func TestParseImplicitAnd(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"a", "                        a"},
+		{"a b", "                      AND[a,b]"},
+		{"a b c", "                    AND[a,b,c]"},
+		{"a AND b c", "                AND[a,b,c]"},
+		{"a b OR c", "                 OR[AND[a,b],c]"},
+		{"a OR b c", "                 OR[a,AND[b,c]]"},
+		{"a OR b c OR d", "            OR[a,AND[b,c],d]"},
+		{"a NOT b", "                  AND[a,NOT[b]]"},
+		{"NOT a b", "                  AND[NOT[a],b]"},
+		{"a ( b OR c )", "             AND[a,OR[b,c]]"},
+		{"( a OR b ) ( c OR d )", "    AND[OR[a,b],OR[c,d]]"},
+		{"( a b ) OR c", "             OR[AND[a,b],c]"},
+		{"a /b/", "                    AND[a,b]"},
+		{"a OR", "                     err: unexpected end of expression at 4"},
+		{"a )", "                      err: unexpected \")\" at 2"},
+		{"a b AND", "                  err: unexpected end of expression at 7"},
+	} {
+		node, err := ParseWithOptions(newFakeLexer(tt.input), ParseOptions{ImplicitAnd: true})
+		want := strings.TrimSpace(tt.want)
+		var have string
+		if err != nil {
+			serr := err.(*SyntaxError)
+			have = fmt.Sprintf("err: %s at %d", serr.Msg, serr.Pos)
+		} else {
+			have = dumpNode(0, node)
+		}
+		is.Eqf(want, have, "testcase '%s'", tt.input)
+	}
+	_, err := ParseWithOptions(newFakeLexer("a )"), ParseOptions{ImplicitAnd: true})
+	is.Eq("AND OR XOR IMPLIES NEAR/n BEFORE/n THEN literal ( NOT ATLEAST EXACTLY ATMOST end of expression", strings.Join(err.(*SyntaxError).Expected, " "))
+}
+
+func TestParseExpected(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	is := Assert(t)
+	for _, tt := range []testcase{
+		{"a b", "         AND OR XOR IMPLIES NEAR/n BEFORE/n THEN end of expression"},
+		{"( a b )", "     AND OR XOR IMPLIES NEAR/n BEFORE/n THEN )"},
+		{"a AND", "       literal ( NOT ATLEAST EXACTLY ATMOST"},
+		{"a AND )", "     literal ( NOT ATLEAST EXACTLY ATMOST"},
+		{"NOT ( a", "     AND OR XOR IMPLIES NEAR/n BEFORE/n THEN )"},
+		{"ATLEAST_1 ( a b", "  AND OR XOR IMPLIES NEAR/n BEFORE/n THEN , )"},
+		{"ATLEAST_1 a", "      ("},
+	} {
+		_, err := Parse(newFakeLexer(tt.input))
+		serr, ok := err.(*SyntaxError)
+		is.True(ok)
+		is.Eqf(strings.TrimSpace(tt.want), strings.Join(serr.Expected, " "), "testcase '%s'", tt.input)
+	}
+}
+
 func dumpNode(level int, node Node) string {
 	if level > 100 {
 		panic("dumpNode: too deep")
 	}
 	str := node.Text
+	if node.Typ == RefNode {
+		str = "$" + str
+	}
 	if len(node.Subnodes) > 0 {
 		str += "["
 		for i, child := range node.Subnodes {
@@ -132,6 +276,7 @@ func dumpNode(level int, node Node) string {
 // A fakeLexer yields pre-defined tokens.
 type fakeLexer struct {
 	toks []string
+	pos  int
 }
 
 func newFakeLexer(input string) *fakeLexer {
@@ -139,36 +284,61 @@ func newFakeLexer(input string) *fakeLexer {
 	if input != "" {
 		toks = strings.Split(input, " ")
 	}
-	return &fakeLexer{toks}
+	return &fakeLexer{toks, 0}
 }
 
 func (l *fakeLexer) NextToken() (Token, error) {
 	if len(l.toks) == 0 {
-		return Token{EOFToken, "EOF"}, nil
+		return Token{Typ: EOFToken, Text: "EOF", Pos: l.pos, End: l.pos}, nil
 	}
 	tok := l.toks[0]
 	l.toks = l.toks[1:]
+	pos, end := l.pos, l.pos+len(tok)
+	l.pos = end + 1
+	if len(l.toks) == 0 {
+		l.pos = end
+	}
 	switch tok {
 	case "(":
-		return Token{OpenToken, "("}, nil
+		return Token{Typ: OpenToken, Text: "(", Pos: pos, End: end}, nil
 	case ")":
-		return Token{CloseToken, ")"}, nil
+		return Token{Typ: CloseToken, Text: ")", Pos: pos, End: end}, nil
 	case "NOT":
-		return Token{NotToken, "NOT"}, nil
+		return Token{Typ: NotToken, Text: "NOT", Pos: pos, End: end}, nil
 	case "AND":
-		return Token{AndToken, "AND"}, nil
+		return Token{Typ: AndToken, Text: "AND", Pos: pos, End: end}, nil
 	case "OR":
-		return Token{OrToken, "OR"}, nil
+		return Token{Typ: OrToken, Text: "OR", Pos: pos, End: end}, nil
+	case "XOR":
+		return Token{Typ: XorToken, Text: "XOR", Pos: pos, End: end}, nil
+	case "IMPLIES":
+		return Token{Typ: ImpliesToken, Text: "IMPLIES", Pos: pos, End: end}, nil
+	case "THEN":
+		return Token{Typ: ThenToken, Text: "THEN", Pos: pos, End: end}, nil
+	case ",":
+		return Token{Typ: CommaToken, Text: ",", Pos: pos, End: end}, nil
+	}
+	if strings.HasPrefix(tok, "$") {
+		return Token{Typ: RefToken, Text: tok[1:], Pos: pos, End: end}, nil
+	}
+	if strings.HasPrefix(tok, "ATLEAST_") || strings.HasPrefix(tok, "EXACTLY_") || strings.HasPrefix(tok, "ATMOST_") {
+		return Token{Typ: ThresholdToken, Text: strings.Replace(tok, "_", " ", 1), Pos: pos, End: end}, nil
+	}
+	if strings.HasPrefix(tok, "NEAR/") {
+		return Token{Typ: NearToken, Text: tok, Pos: pos, End: end}, nil
+	}
+	if strings.HasPrefix(tok, "BEFORE/") {
+		return Token{Typ: BeforeToken, Text: tok, Pos: pos, End: end}, nil
 	}
 	if strings.HasPrefix(tok, "/") && strings.HasSuffix(tok, "/") {
 		tok = tok[1 : len(tok)-1]
 		if len(tok) == 0 {
 			panic("cannot have empty regex token")
 		}
-		return Token{RegexToken, tok}, nil
+		return Token{Typ: RegexToken, Text: tok, Pos: pos, End: end}, nil
 	}
 	if len(tok) == 0 {
 		panic("cannot have empty string token")
 	}
-	return Token{StringToken, tok}, nil
+	return Token{Typ: StringToken, Text: tok, Pos: pos, End: end}, nil
 }
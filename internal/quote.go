@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Precedences of operators, from lowest to highest.
+// They are used for rendering expressions with minimal parentheses.
+const (
+	ImpliesPrec = iota + 1
+	OrPrec
+	XorPrec
+	AndPrec
+	NearPrec
+	NotPrec
+	LiteralPrec
+)
+
+// Paren renders str, which has precedence prec, as an operand
+// of an operator with precedence opPrec.
+func Paren(str string, prec, opPrec int) string {
+	if prec < opPrec {
+		return "(" + str + ")"
+	}
+	return str
+}
+
+// QuoteString renders a string literal so that the lexer yields
+// a StringToken with text str. Strings that would need escaping are
+// rendered as double-quoted strings.
+func QuoteString(str string) string {
+	return quote(str, false)
+}
+
+func quote(str string, glob bool) string {
+	if needsQuotes(str, glob) {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// QuoteFlaggedString renders a string literal so that the lexer yields
+// a StringToken with text str and the given flags, any of "iwg^$".
+func QuoteFlaggedString(str, flags string) string {
+	var sb strings.Builder
+	if strings.Contains(flags, "i") {
+		sb.WriteString("~")
+	}
+	if strings.Contains(flags, "w") {
+		sb.WriteString("word:")
+	}
+	if strings.Contains(flags, "g") {
+		sb.WriteString("glob:")
+	}
+	if strings.Contains(flags, "^") {
+		sb.WriteString("^")
+	}
+	sb.WriteString(quote(str, strings.Contains(flags, "g")))
+	if strings.Contains(flags, "$") {
+		sb.WriteString("$")
+	}
+	return sb.String()
+}
+
+// needsQuotes reports whether str must be quoted. Wildcards must be
+// quoted unless str is a glob pattern, for expressions in glob mode.
+func needsQuotes(str string, glob bool) bool {
+	// keywords and prefixes of all dialects
+	switch str {
+	case "", "NOT", "AND", "OR", "XOR", "IMPLIES", "THEN", "ATLEAST", "EXACTLY", "ATMOST",
+		"not", "and", "or", "xor", "implies", "then", "atleast", "exactly", "atmost", "&&", "||":
+		return true
+	}
+	if !utf8.ValidString(str) {
+		// the lexer reads runes, only quoted strings can have other bytes
+		return true
+	}
+	if strings.IndexAny(str, "~\"!+-^") == 0 || strings.HasPrefix(str, "word:") || strings.HasPrefix(str, "glob:") || strings.HasSuffix(str, "$") {
+		return true
+	}
+	if strings.HasPrefix(str, "$") && IsName(str[1:]) {
+		// would be a reference
+		return true
+	}
+	if isCall(str) {
+		// would be a function call
+		return true
+	}
+	if i := strings.LastIndexByte(str, '{'); i >= 0 && countSuffixLen(str[i:]) == len(str)-i {
+		// would be a count suffix
+		return true
+	}
+	return strings.ContainsFunc(str, func(r rune) bool {
+		return strings.ContainsRune(" ()/\\,", r) || !glob && (r == '*' || r == '?') || !unicode.IsPrint(r)
+	})
+}
+
+// FormatCount renders an occurrence count suffix like '{2}', '{2,}' or
+// '{2,5}'. A negative max means there is no maximum.
+func FormatCount(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	}
+	return fmt.Sprintf("{%d,%d}", min, max)
+}
+
+// FormatCall renders a function call like '@name' or '@name(a, "b c")'.
+// Arguments that would need escaping are rendered as double-quoted strings.
+func FormatCall(name string, args []string) string {
+	if len(args) == 0 {
+		return "@" + name
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = arg
+		if arg == "" || arg != strings.TrimSpace(arg) || !utf8.ValidString(arg) || strings.ContainsFunc(arg, func(r rune) bool {
+			return strings.ContainsRune("\"(),", r) || !unicode.IsPrint(r)
+		}) {
+			strs[i] = strconv.Quote(arg)
+		}
+	}
+	return "@" + name + "(" + strings.Join(strs, ", ") + ")"
+}
+
+// QuoteRegex renders a regex literal so that the lexer yields
+// a RegexToken with text str.
+func QuoteRegex(str string) string {
+	var sb strings.Builder
+	sb.WriteRune('/')
+	for _, r := range str {
+		switch r {
+		case '/', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteRune('/')
+	return sb.String()
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	is := Assert(t)
+	for _, str := range []string{
+		"a",
+		"a b",
+		" a ",
+		"(a)",
+		"/a/",
+		"\\a\\",
+		"ä ö",
+		"NOTE",
+		"\ta\t",
+		"~a",
+		"a~",
+		"",
+		"AND",
+		"\"a\"",
+		"a\"b",
+		"\x00\n",
+		"-a",
+		"+a",
+		"!a",
+		"and",
+		"THEN",
+		"then",
+		"&&",
+		"word:a",
+		"word:",
+		"words:a",
+		"^a",
+		"a$",
+		"$",
+		"a$b",
+		"^",
+		"a*b",
+		"?",
+		"glob:a",
+		"a,b",
+		"a{2}",
+		"a{2,5}",
+		"{2}",
+		"a{2}b",
+		"ATLEAST",
+		"XOR",
+		"$a",
+		"$_a1",
+		"$1",
+		"implies",
+		"atmost",
+		"@a",
+		"@a(b)",
+		"a@b",
+	} {
+		lex, err := NewStringLexer(QuoteString(str))
+		is.NoErr(err)
+		tok, err := lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(StringToken, tok.Typ, "QuoteString(%q)", str)
+		is.Eqf(str, tok.Text, "QuoteString(%q)", str)
+		lex, err = NewStringLexer(QuoteRegex(str))
+		is.NoErr(err)
+		tok, err = lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(RegexToken, tok.Typ, "QuoteRegex(%q)", str)
+		is.Eqf(str, tok.Text, "QuoteRegex(%q)", str)
+		lex, err = NewStringLexerWithOptions(QuoteString(str), LexOptions{Extended: true})
+		is.NoErr(err)
+		tok, err = lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(StringToken, tok.Typ, "QuoteString(%q) extended", str)
+		is.Eqf(str, tok.Text, "QuoteString(%q) extended", str)
+		lex, err = NewStringLexerWithOptions(QuoteString(str), LexOptions{Refs: true})
+		is.NoErr(err)
+		tok, err = lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(StringToken, tok.Typ, "QuoteString(%q) refs", str)
+		is.Eqf(str, tok.Text, "QuoteString(%q) refs", str)
+		lex, err = NewStringLexerWithOptions(QuoteString(str), LexOptions{Funcs: true})
+		is.NoErr(err)
+		tok, err = lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(StringToken, tok.Typ, "QuoteString(%q) funcs", str)
+		is.Eqf(str, tok.Text, "QuoteString(%q) funcs", str)
+		for _, flags := range []string{"i", "w", "g", "^", "$", "^$", "iw^$", "ig^$"} {
+			lex, err = NewStringLexer(QuoteFlaggedString(str, flags))
+			is.NoErr(err)
+			tok, err = lex.NextToken()
+			is.NoErr(err)
+			is.Eqf(StringToken, tok.Typ, "QuoteFlaggedString(%q, %q)", str, flags)
+			is.Eqf(str, tok.Text, "QuoteFlaggedString(%q, %q)", str, flags)
+			is.Eqf(flags, tok.Flags, "QuoteFlaggedString(%q, %q)", str, flags)
+		}
+	}
+	// bytes that are not valid UTF-8 are quoted, regexes cannot have them
+	for _, str := range []string{"\xff", "a\xc3", "\xff\xfe"} {
+		lex, err := NewStringLexer(QuoteString(str))
+		is.NoErr(err)
+		tok, err := lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(str, tok.Text, "QuoteString(%q)", str)
+	}
+	is.Eq(`""`, QuoteString(""))
+	is.Eq(`"AND"`, QuoteString("AND"))
+	is.Eq(`abc`, QuoteString("abc"))
+	is.Eq(`"a b"`, QuoteString("a b"))
+	is.Eq(`"a\tb"`, QuoteString("a\tb"))
+	is.Eq(`~"a b"`, QuoteFlaggedString("a b", "i"))
+	is.Eq(`^"a b"$`, QuoteFlaggedString("a b", "^$"))
+	is.Eq(`~word:^ab$`, QuoteFlaggedString("ab", "iw^$"))
+	is.Eq(`"a*"`, QuoteString("a*"))
+	is.Eq(`glob:a*`, QuoteFlaggedString("a*", "g"))
+	for _, args := range [][]string{nil, {"a"}, {"10.0.0.0/8", "::1/128"}, {"a b", " a", "", "a,b", "(", "\"", "\t"}} {
+		lex, err := NewStringLexerWithOptions(FormatCall("f", args), LexOptions{Funcs: true})
+		is.NoErr(err)
+		tok, err := lex.NextToken()
+		is.NoErr(err)
+		is.Eqf(FuncToken, tok.Typ, "FormatCall(%q)", args)
+		is.Eqf(fmt.Sprint(args), fmt.Sprint(tok.Args), "FormatCall(%q)", args)
+	}
+	is.Eq(`@f(a, b c, "", "d,e")`, FormatCall("f", []string{"a", "b c", "", "d,e"}))
+}